@@ -0,0 +1,90 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// minAlertCalls is how many upstream calls the window must hold before its
+// error rate can raise an alert, so a single early failure doesn't.
+const minAlertCalls = 10
+
+// errorRateWindow tracks the outcome of upstream calls over a sliding window
+// and logs an alert when the share that failed reaches UPSTREAM_ERROR_ALERT_RATE.
+// The alert is logged once when the rate crosses the threshold and again only
+// after it has dropped back below it.
+type errorRateWindow struct {
+	mu       sync.Mutex
+	calls    []upstreamOutcome
+	alerting bool
+}
+
+type upstreamOutcome struct {
+	at     time.Time
+	failed bool
+}
+
+var upstreamErrors errorRateWindow
+
+// record adds the outcome of an upstream call and checks the rate against
+// the threshold.
+func (w *errorRateWindow) record(failed bool) {
+	if cfg.UpstreamErrorAlertRate == 0 {
+		return
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	now := time.Now()
+	w.calls = append(w.calls, upstreamOutcome{at: now, failed: failed})
+	w.prune(now)
+
+	rate, total := w.rate()
+	switch {
+	case !w.alerting && total >= minAlertCalls && rate >= cfg.UpstreamErrorAlertRate:
+		w.alerting = true
+		log.Printf("ALERT: upstream error rate is %.0f%% over the last %s (%d calls), above UPSTREAM_ERROR_ALERT_RATE %.0f%%\n",
+			rate*100, cfg.UpstreamErrorWindow, total, cfg.UpstreamErrorAlertRate*100)
+	case w.alerting && rate < cfg.UpstreamErrorAlertRate:
+		w.alerting = false
+		log.Printf("Upstream error rate back to %.0f%% over the last %s, alert cleared\n", rate*100, cfg.UpstreamErrorWindow)
+	}
+}
+
+// prune drops outcomes older than the window. The caller holds w.mu.
+func (w *errorRateWindow) prune(now time.Time) {
+	cutoff := now.Add(-cfg.UpstreamErrorWindow)
+	i := 0
+	for i < len(w.calls) && w.calls[i].at.Before(cutoff) {
+		i++
+	}
+	w.calls = w.calls[i:]
+}
+
+// rate returns the share of calls in the window that failed and how many
+// calls it holds. The caller holds w.mu.
+func (w *errorRateWindow) rate() (float64, int) {
+	if len(w.calls) == 0 {
+		return 0, 0
+	}
+	failed := 0
+	for _, call := range w.calls {
+		if call.failed {
+			failed++
+		}
+	}
+	return float64(failed) / float64(len(w.calls)), len(w.calls)
+}
+
+// snapshot returns the current error rate and whether the alert is raised,
+// for /stats.
+func (w *errorRateWindow) snapshot() (float64, bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.prune(time.Now())
+	rate, _ := w.rate()
+	return rate, w.alerting
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"log"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// temperatureRule sets the temperature for questions containing keyword.
+type temperatureRule struct {
+	keyword     string
+	temperature float64
+}
+
+// defaultTemperatureRules keep factual and coding questions near
+// deterministic and let creative ones wander.
+const defaultTemperatureRules = "code:0.2,function:0.2,debug:0.2,error:0.2,calculate:0.1,define:0.3,what is:0.3," +
+	"poem:1.0,story:1.0,creative:1.0,brainstorm:1.1,ideas:0.9"
+
+// loadTemperatureRules parses AUTO_TEMPERATURE_RULES, an ordered
+// "keyword:temperature" list where the first keyword found in a question
+// wins. A malformed entry is fatal.
+func loadTemperatureRules() []temperatureRule {
+	raw := os.Getenv("AUTO_TEMPERATURE_RULES")
+	if raw == "" {
+		raw = defaultTemperatureRules
+	}
+
+	rules := []temperatureRule{}
+	for _, entry := range strings.Split(raw, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		keyword, value, ok := strings.Cut(entry, ":")
+		keyword = strings.ToLower(strings.TrimSpace(keyword))
+		temperature, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+		if !ok || keyword == "" || err != nil || temperature < 0 || temperature > 2 {
+			log.Fatalf("Invalid AUTO_TEMPERATURE_RULES entry %q: expected keyword:temperature with a temperature between 0 and 2\n", entry)
+		}
+		rules = append(rules, temperatureRule{keyword: keyword, temperature: temperature})
+	}
+	return rules
+}
+
+// applyAutoTemperature sets payload's temperature from the first
+// AUTO_TEMPERATURE_RULES keyword in req's question, unless the request's
+// profile or raw_payload sets one itself.
+func applyAutoTemperature(payload map[string]interface{}, req *chatRequest) {
+	if req.Profile != nil && req.Profile.Temperature != nil {
+		return
+	}
+	if _, ok := req.RawPayload["temperature"]; ok {
+		return
+	}
+
+	question := strings.ToLower(req.Question)
+	for _, rule := range cfg.TemperatureRules {
+		if strings.Contains(question, rule.keyword) {
+			log.Printf("Auto temperature %v: question mentions %q\n", rule.temperature, rule.keyword)
+			payload["temperature"] = rule.temperature
+			return
+		}
+	}
+}
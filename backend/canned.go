@@ -0,0 +1,58 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// cannedModel is reported as the model of canned answers.
+const cannedModel = "canned"
+
+// loadCannedAnswers reads the JSON object of question to answer in
+// CANNED_ANSWERS_PATH, keyed by normalized question. A bad file is fatal.
+func loadCannedAnswers() map[string]string {
+	path := os.Getenv("CANNED_ANSWERS_PATH")
+	if path == "" {
+		return nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		log.Fatalf("Error reading CANNED_ANSWERS_PATH: %v\n", err)
+	}
+	var fromFile map[string]string
+	if err := json.Unmarshal(data, &fromFile); err != nil {
+		log.Fatalf("Error parsing CANNED_ANSWERS_PATH, expected an object of question to answer: %v\n", err)
+	}
+	answers := make(map[string]string, len(fromFile))
+	for question, answer := range fromFile {
+		answers[normalizeQuestion(question)] = answer
+	}
+	return answers
+}
+
+// normalizeQuestion lowercases question, collapses its whitespace and drops
+// trailing punctuation, so trivially different phrasings match.
+func normalizeQuestion(question string) string {
+	question = strings.Join(strings.Fields(strings.ToLower(question)), " ")
+	return strings.TrimRight(question, "?!. ")
+}
+
+// cannedAnswer looks question up in the canned answers. With CANNED_ONLY on,
+// a question that has none is an error instead of going upstream.
+func cannedAnswer(question string) (*completion, error) {
+	if answer, ok := cfg.CannedAnswers[normalizeQuestion(question)]; ok {
+		return &completion{Answer: answer, Model: cannedModel, FinishReason: "stop"}, nil
+	}
+	if cfg.CannedOnly {
+		return nil, &apiError{
+			Status:  http.StatusNotFound,
+			Message: "No canned answer for this question",
+			Code:    "not_canned",
+		}
+	}
+	return nil, nil
+}
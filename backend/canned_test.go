@@ -0,0 +1,39 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+)
+
+// TestCannedAnswerSkipsUpstream checks a canned answer makes no upstream
+// call, not even for suggestions.
+func TestCannedAnswerSkipsUpstream(t *testing.T) {
+	canned := filepath.Join(t.TempDir(), "canned.json")
+	if err := os.WriteFile(canned, []byte(`{"what are your hours": "Nine to five."}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	var upstreamCalls atomic.Int32
+	app := newTestApp(t, func(w http.ResponseWriter, r *http.Request) {
+		upstreamCalls.Add(1)
+		writeCompletion(w, "What about weekends?")
+	}, map[string]string{
+		"CANNED_ANSWERS_PATH": canned,
+		"ENABLE_SUGGESTIONS":  "true",
+	})
+
+	for i := 0; i < 2; i++ {
+		status, body := postChat(t, app, "/chat/", `{"question": "What are your hours?"}`)
+		if status != http.StatusOK || body["answer"] != "Nine to five." {
+			t.Fatalf("got %d %v, want the canned answer", status, body)
+		}
+		if _, ok := body["suggestions"]; ok {
+			t.Errorf("canned answer got suggestions: %v", body["suggestions"])
+		}
+	}
+	if n := upstreamCalls.Load(); n != 0 {
+		t.Errorf("upstream called %d times for a canned answer", n)
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import "strings"
+
+// codeBlock is a fenced code block found in an answer.
+type codeBlock struct {
+	Language string `json:"language"`
+	Content  string `json:"content"`
+}
+
+// extractCodeBlocks returns the fenced code blocks in a Markdown answer. It
+// follows the CommonMark fence rules: a fence is three or more backticks or
+// tildes indented at most three spaces, the first word of its info string is
+// the language, and it is closed only by a fence of the same character that is
+// at least as long. That lets a ```` block contain ``` lines verbatim. A fence
+// left open runs to the end of the answer.
+func extractCodeBlocks(answer string) []codeBlock {
+	blocks := []codeBlock{}
+
+	var (
+		open     bool
+		fence    string
+		language string
+		content  []string
+	)
+	for _, line := range strings.Split(answer, "\n") {
+		marker, info, ok := parseFence(line)
+
+		if !open {
+			if ok && !(marker[0] == '`' && strings.Contains(info, "`")) {
+				open, fence, content = true, marker, nil
+				language = ""
+				if fields := strings.Fields(info); len(fields) > 0 {
+					language = fields[0]
+				}
+			}
+			continue
+		}
+
+		if ok && info == "" && marker[0] == fence[0] && len(marker) >= len(fence) {
+			blocks = append(blocks, codeBlock{Language: language, Content: strings.Join(content, "\n")})
+			open = false
+			continue
+		}
+		content = append(content, line)
+	}
+
+	if open {
+		blocks = append(blocks, codeBlock{Language: language, Content: strings.Join(content, "\n")})
+	}
+	return blocks
+}
+
+// parseFence splits a fence line into its marker (the run of backticks or
+// tildes) and trimmed info string.
+func parseFence(line string) (marker, info string, ok bool) {
+	line = strings.TrimRight(line, "\r")
+	trimmed := strings.TrimLeft(line, " ")
+	if len(line)-len(trimmed) > 3 || len(trimmed) < 3 {
+		return "", "", false
+	}
+
+	c := trimmed[0]
+	if c != '`' && c != '~' {
+		return "", "", false
+	}
+	n := 0
+	for n < len(trimmed) && trimmed[n] == c {
+		n++
+	}
+	if n < 3 {
+		return "", "", false
+	}
+	return trimmed[:n], strings.TrimSpace(trimmed[n:]), true
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/utils"
+)
+
+// inFlight counts the requests each client currently has in progress.
+// Clients are dropped when their count returns to 0, so it only holds active
+// clients.
+var inFlight = newStore[string, int]()
+
+// limitConcurrentPerClient answers 429 when the client, identified by IP,
+// already has MAX_CONCURRENT_PER_CLIENT requests in flight. The count is
+// released when the request finishes, including on errors and panics.
+func limitConcurrentPerClient(c *fiber.Ctx) error {
+	if cfg.MaxConcurrentPerClient == 0 {
+		return c.Next()
+	}
+
+	client := utils.CopyString(c.IP())
+	admitted := false
+	inFlight.update(client, func(count int, ok bool) (int, bool) {
+		if count >= cfg.MaxConcurrentPerClient {
+			return count, ok
+		}
+		admitted = true
+		return count + 1, true
+	})
+	if !admitted {
+		return errorResponse(c, &apiError{
+			Status:  http.StatusTooManyRequests,
+			Message: "Too many concurrent requests from this client",
+			Code:    "too_many_concurrent",
+		})
+	}
+
+	defer inFlight.update(client, func(count int, _ bool) (int, bool) {
+		return count - 1, count > 1
+	})
+	return c.Next()
+}
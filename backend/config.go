@@ -0,0 +1,704 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// config holds the settings read from the environment at startup.
+type config struct {
+	// APIKeys authenticate requests to the NVIDIA NIM API. With more than one,
+	// upstream calls rotate through them.
+	APIKeys *keyPool
+
+	// APIURL is the chat completions endpoint under NVIDIA_BASE_URL.
+	APIURL string
+
+	// RequestTemplate renders upstream request bodies from the payload and
+	// AnswerPath locates the answer in responses, so providers with their own
+	// schema can be used. The defaults are the OpenAI shape.
+	RequestTemplate *template.Template
+	AnswerPath      string
+
+	// ExtraHeaders are set on every upstream request after the standard
+	// headers, e.g. API versions or routing hints for a gateway.
+	ExtraHeaders map[string]string
+
+	// FieldAliases maps legacy /chat/ request field names to the canonical
+	// ones they are renamed to.
+	FieldAliases map[string]string
+
+	// SystemTemplate and UserTemplate, when set, render the system and user
+	// messages sent upstream instead of the default prompt and raw question.
+	SystemTemplate *template.Template
+	UserTemplate   *template.Template
+
+	// Personas maps the names requests can pass as "persona" to their system
+	// prompts.
+	Personas map[string]string
+
+	// Profiles are the named configuration profiles requests can select.
+	Profiles map[string]profile
+
+	// MaxUploadBytes caps each file uploaded with a multipart /chat/ request.
+	MaxUploadBytes int
+
+	// MaxSystemAffixChars caps the combined length of a request's
+	// system_prefix and system_suffix.
+	MaxSystemAffixChars int
+
+	// MaxContextChars caps the combined length of the request's "context"
+	// strings.
+	MaxContextChars int
+
+	// VerifyAnswerLanguage retries once with a stronger instruction when the
+	// answer is not in the requested language.
+	VerifyAnswerLanguage bool
+
+	// TLSCertFile and TLSKeyFile, when both set, make the server terminate TLS
+	// itself.
+	TLSCertFile string
+	TLSKeyFile  string
+
+	// RedactPrompts replaces question and answer text in logs with a hash and
+	// length.
+	RedactPrompts bool
+
+	// MinAnswerChars retries once when the answer is shorter than this many
+	// characters, ignoring surrounding whitespace. 0 disables the check.
+	MinAnswerChars int
+
+	// VerboseResponse adds request metadata to /chat/ responses alongside the
+	// answer.
+	VerboseResponse bool
+
+	// DryRun skips the upstream API and returns a canned answer after
+	// DryRunLatency, for load testing the server on its own.
+	DryRun        bool
+	DryRunLatency time.Duration
+
+	// NATSURL, when set, publishes every completed chat to NATSSubject.
+	NATSURL     string
+	NATSSubject string
+
+	// ExtractCode adds the answer's fenced code blocks to responses as
+	// code_blocks. Requests can also ask for it with "extract_code".
+	ExtractCode bool
+
+	// TrimAnswer strips leading and trailing whitespace from answers.
+	// Requests can override it with "features": {"trim_answer": ...}.
+	TrimAnswer bool
+
+	// AllowEmptyAnswer returns an empty answer flagged with empty_answer
+	// instead of failing with a 502.
+	AllowEmptyAnswer bool
+
+	// AcceptedContentTypes are the request media types whose bodies are
+	// parsed as JSON; anything else is answered with 415.
+	AcceptedContentTypes []string
+
+	// UpstreamLogSampleRate is the fraction of upstream calls whose request
+	// and response bodies are logged. Metadata is logged for every call.
+	UpstreamLogSampleRate float64
+
+	// ShutdownReadyDelay is how long /health/ready fails before the server
+	// stops accepting connections on shutdown.
+	ShutdownReadyDelay time.Duration
+
+	// UpstreamTimeout bounds each upstream call, unless ModelTimeouts has an
+	// entry for the call's model. 0 means no limit.
+	UpstreamTimeout time.Duration
+	ModelTimeouts   map[string]time.Duration
+
+	// ResponseHeaderTimeout bounds how long the upstream may take to start
+	// responding once the request is sent. 0 means no limit.
+	ResponseHeaderTimeout time.Duration
+
+	// RemoteConfigURL, when set, serves the default model and system prompt,
+	// refetched every RemoteConfigRefresh.
+	RemoteConfigURL     string
+	RemoteConfigRefresh time.Duration
+
+	// MaxConcurrentPerClient caps the /chat requests one client IP can have in
+	// flight at once. 0 means no limit.
+	MaxConcurrentPerClient int
+
+	// EnableEchoModel lets requests ask for the "echo" model, which answers
+	// with the question (transformed by EchoModelTransform: none, upper or
+	// reverse) without calling the upstream.
+	EnableEchoModel    bool
+	EchoModelTransform string
+
+	// DowngradeThreshold is the number of upstream calls in flight at which
+	// new requests for a model in DowngradeModels use its cheaper
+	// replacement instead. 0 disables downgrading.
+	DowngradeThreshold int
+	DowngradeModels    map[string]string
+
+	// RateLimitSlowdown delays upstream calls while the upstream reports
+	// fewer than RateLimitSlowdownThreshold requests remaining. 0 disables
+	// the delay.
+	RateLimitSlowdown          time.Duration
+	RateLimitSlowdownThreshold int
+
+	// RetryOnParseError retries an upstream call once when a 200 response
+	// body fails to parse.
+	RetryOnParseError bool
+
+	// EnableModelFallback retries once with FallbackModel when the upstream
+	// reports the model as not found.
+	EnableModelFallback bool
+	FallbackModel       string
+
+	// UpstreamErrorAlertRate is the share of upstream calls failing within
+	// UpstreamErrorWindow at which an alert is logged. 0 disables it.
+	UpstreamErrorAlertRate float64
+	UpstreamErrorWindow    time.Duration
+
+	// DebugEndpoints serves GET /debug/recent with the last DebugRecentSize
+	// requests, behind DebugToken, which it requires.
+	DebugEndpoints  bool
+	DebugRecentSize int
+	DebugToken      string
+
+	// Transliterate adds an ASCII-only copy of each answer to responses, for
+	// terminals that can't show every script.
+	Transliterate bool
+
+	// PriorityHighLimit and PriorityLowLimit cap the upstream calls in
+	// flight for each request priority. 0 means no cap.
+	PriorityHighLimit int
+	PriorityLowLimit  int
+
+	// MaxRequestDeadline clamps how far in the future a client's
+	// X-Request-Deadline can be. 0 means no clamp.
+	MaxRequestDeadline time.Duration
+
+	// PostProcessWebhookURL, when set, is sent every /chat/ answer and
+	// returns the answer to use instead, within PostProcessWebhookTimeout.
+	PostProcessWebhookURL     string
+	PostProcessWebhookTimeout time.Duration
+
+	// CannedAnswers are answers served for their questions without calling
+	// the upstream, keyed by normalized question. With CannedOnly, other
+	// questions are rejected.
+	CannedAnswers map[string]string
+	CannedOnly    bool
+
+	// PageSizeChars is the page size for requests with "paginate": true,
+	// whose later pages are kept for PageTTL.
+	PageSizeChars int
+	PageTTL       time.Duration
+
+	// SigningSecret, when set, is the HMAC key every /chat and /tokens
+	// request body must be signed with in X-Signature.
+	SigningSecret string
+
+	// VerbosityInstructions maps each request verbosity to the instruction
+	// added to the system prompt for it.
+	VerbosityInstructions map[string]string
+
+	// UpstreamRedirectPolicy is "same-host" or "follow", see
+	// checkUpstreamRedirect.
+	UpstreamRedirectPolicy string
+
+	// StatusRetries is how many times an upstream call is retried after
+	// each upstream status. Statuses not listed aren't retried.
+	StatusRetries map[int]int
+
+	// AllowRawPayload lets requests merge a raw_payload object over the
+	// upstream payload.
+	AllowRawPayload bool
+
+	// ModelPricing prices each model's tokens for cost estimates.
+	ModelPricing map[string]modelPrice
+
+	// MaxQuestionChars caps the length of a question, 0 for no limit. Longer
+	// questions are rejected, or cut to the limit when TruncateInput is on.
+	MaxQuestionChars int
+	TruncateInput    bool
+
+	// EnableSuggestions adds follow-up questions from SuggestionsModel to
+	// each answer, at the cost of a second upstream call.
+	EnableSuggestions bool
+	SuggestionsModel  string
+
+	// CORSExposeHeaders lists the response headers browsers let scripts
+	// read; CORSAllowCredentials lets them send cookies and auth headers.
+	CORSExposeHeaders    string
+	CORSAllowCredentials bool
+
+	// MemPressureThresholdMB is the heap size above which new requests are
+	// rejected until it shrinks, 0 to never reject.
+	MemPressureThresholdMB int
+
+	// UpstreamEndpoints are the base URLs of the upstream's regions, each
+	// call going to the fastest healthy one; empty to use NVIDIA_BASE_URL
+	// alone. UpstreamProbeInterval is how often they are health checked.
+	UpstreamEndpoints     []string
+	UpstreamProbeInterval time.Duration
+
+	// SplitReasoning moves the sections of the answer ReasoningPattern
+	// matches into a separate reasoning field; OmitReasoningFromLogs keeps
+	// them out of logged response bodies.
+	SplitReasoning        bool
+	ReasoningPattern      *regexp.Regexp
+	OmitReasoningFromLogs bool
+
+	// AutoTemperature picks the temperature from TemperatureRules by the
+	// keywords in the question when the request doesn't set one.
+	AutoTemperature  bool
+	TemperatureRules []temperatureRule
+
+	// EnableEscalation sends requests to EscalationCheapModel first and asks
+	// EscalationModel again when the answer is under EscalationMinChars or
+	// contains one of EscalationPhrases.
+	EnableEscalation     bool
+	EscalationCheapModel string
+	EscalationModel      string
+	EscalationMinChars   int
+	EscalationPhrases    []string
+
+	// TraceFilePath, when set, gets a JSON line per /chat request, rotated
+	// at TraceFileMaxMB with TraceFileMaxFiles old files kept.
+	TraceFilePath     string
+	TraceFileMaxMB    int
+	TraceFileMaxFiles int
+
+	// ForwardUser passes requests' "user" field on to the upstream.
+	ForwardUser bool
+}
+
+var cfg config
+
+// loadConfig reads the configuration from the environment. It must run after
+// the .env file has been loaded.
+func loadConfig() {
+	cfg.APIKeys = newKeyPool(loadAPIKeys(), time.Duration(envInt("API_KEY_COOLDOWN_MS", 60000))*time.Millisecond)
+	cfg.APIURL = loadAPIURL()
+	cfg.RequestTemplate = loadRequestTemplate()
+	cfg.AnswerPath = envString("UPSTREAM_ANSWER_PATH", defaultAnswerPath)
+	cfg.ExtraHeaders = parseExtraHeaders(os.Getenv("UPSTREAM_EXTRA_HEADERS"))
+	cfg.FieldAliases = parsePairList("FIELD_ALIASES")
+	cfg.SystemTemplate = loadPromptTemplate("SYSTEM_PROMPT_TEMPLATE")
+	cfg.UserTemplate = loadPromptTemplate("USER_PROMPT_TEMPLATE")
+	cfg.Personas = loadPersonas()
+	cfg.Profiles = loadProfiles()
+	cfg.MaxContextChars = envInt("MAX_CONTEXT_CHARS", 32000)
+	cfg.MaxUploadBytes = envInt("MAX_UPLOAD_BYTES", 65536)
+	cfg.MaxSystemAffixChars = envInt("MAX_SYSTEM_AFFIX_CHARS", 4000)
+	cfg.VerifyAnswerLanguage = envBool("VERIFY_ANSWER_LANGUAGE")
+	cfg.TLSCertFile, cfg.TLSKeyFile = loadTLSFiles()
+	cfg.RedactPrompts = envBool("REDACT_PROMPTS")
+	cfg.MinAnswerChars = envInt("MIN_ANSWER_CHARS", 0)
+	cfg.VerboseResponse = envBool("VERBOSE_RESPONSE")
+	cfg.DryRun = envBool("DRY_RUN")
+	cfg.DryRunLatency = time.Duration(envInt("DRY_RUN_LATENCY_MS", 0)) * time.Millisecond
+	cfg.NATSURL = os.Getenv("NATS_URL")
+	cfg.NATSSubject = envString("NATS_SUBJECT", "chat.completed")
+	cfg.ExtractCode = envBool("EXTRACT_CODE")
+	cfg.TrimAnswer = envBool("TRIM_ANSWER")
+	cfg.AllowEmptyAnswer = loadEmptyAnswerMode()
+	cfg.AcceptedContentTypes = envList("ACCEPTED_CONTENT_TYPES", "application/json,text/plain")
+	cfg.UpstreamLogSampleRate = envFloat("UPSTREAM_LOG_SAMPLE_RATE", 1, 0, 1)
+	cfg.ShutdownReadyDelay = time.Duration(envInt("SHUTDOWN_READY_DELAY_MS", 0)) * time.Millisecond
+	cfg.EnableModelFallback, cfg.FallbackModel = loadModelFallback()
+	cfg.MaxConcurrentPerClient = envInt("MAX_CONCURRENT_PER_CLIENT", 0)
+	cfg.EnableEchoModel = envBool("ENABLE_ECHO_MODEL")
+	cfg.EchoModelTransform = loadEchoModelTransform()
+	cfg.DowngradeThreshold = envInt("DOWNGRADE_THRESHOLD", 0)
+	cfg.DowngradeModels = parsePairList("DOWNGRADE_MODELS")
+	cfg.RateLimitSlowdown = time.Duration(envInt("RATELIMIT_SLOWDOWN_MS", 0)) * time.Millisecond
+	cfg.RateLimitSlowdownThreshold = envInt("RATELIMIT_SLOWDOWN_THRESHOLD", 10)
+	cfg.RetryOnParseError = envBool("RETRY_ON_PARSE_ERROR")
+	cfg.RemoteConfigURL = os.Getenv("REMOTE_CONFIG_URL")
+	cfg.RemoteConfigRefresh = time.Duration(envInt("REMOTE_CONFIG_REFRESH_MS", 60000)) * time.Millisecond
+	cfg.UpstreamTimeout = time.Duration(envInt("UPSTREAM_TIMEOUT_MS", 0)) * time.Millisecond
+	cfg.ModelTimeouts = loadModelTimeouts()
+	cfg.ResponseHeaderTimeout = time.Duration(envInt("RESPONSE_HEADER_TIMEOUT_MS", 0)) * time.Millisecond
+	cfg.ForwardUser = envBool("FORWARD_USER")
+	cfg.ModelPricing = loadModelPricing()
+	cfg.MaxQuestionChars = envInt("MAX_QUESTION_CHARS", 0)
+	cfg.TruncateInput = envBool("TRUNCATE_INPUT")
+	cfg.EnableSuggestions = envBool("ENABLE_SUGGESTIONS")
+	cfg.SuggestionsModel = envString("SUGGESTIONS_MODEL", "meta/llama3-8b-instruct")
+	cfg.CORSExposeHeaders = envString("CORS_EXPOSE_HEADERS", defaultCORSExposeHeaders)
+	cfg.CORSAllowCredentials = envBool("CORS_ALLOW_CREDENTIALS")
+	cfg.MemPressureThresholdMB = envInt("MEM_PRESSURE_THRESHOLD_MB", 0)
+	cfg.UpstreamEndpoints = loadUpstreamEndpoints()
+	cfg.UpstreamProbeInterval = time.Duration(envInt("UPSTREAM_PROBE_INTERVAL_MS", 30000)) * time.Millisecond
+	cfg.SplitReasoning = envBool("SPLIT_REASONING")
+	cfg.ReasoningPattern = loadReasoningPattern()
+	cfg.OmitReasoningFromLogs = envBool("OMIT_REASONING_FROM_LOGS")
+	cfg.AutoTemperature = envBool("AUTO_TEMPERATURE")
+	cfg.TemperatureRules = loadTemperatureRules()
+	cfg.EnableEscalation, cfg.EscalationCheapModel, cfg.EscalationModel = loadEscalationModels()
+	cfg.EscalationMinChars = envInt("ESCALATION_MIN_CHARS", 20)
+	cfg.EscalationPhrases = envList("ESCALATION_PHRASES", defaultEscalationPhrases)
+	cfg.TraceFilePath = os.Getenv("TRACE_FILE_PATH")
+	cfg.TraceFileMaxMB = envInt("TRACE_FILE_MAX_MB", 100)
+	if cfg.TraceFileMaxMB == 0 {
+		log.Fatal("TRACE_FILE_MAX_MB must be at least 1")
+	}
+	cfg.TraceFileMaxFiles = envInt("TRACE_FILE_MAX_FILES", 5)
+	cfg.AllowRawPayload = envBool("ALLOW_RAW_PAYLOAD")
+	cfg.StatusRetries = loadStatusRetries()
+	cfg.UpstreamRedirectPolicy = loadUpstreamRedirectPolicy()
+	cfg.VerbosityInstructions = loadVerbosityInstructions()
+	cfg.SigningSecret = strings.TrimSpace(readEnvOrFile("WEBHOOK_SIGNING_SECRET"))
+	if cfg.PageSizeChars = envInt("PAGE_SIZE_CHARS", 4000); cfg.PageSizeChars == 0 {
+		log.Fatalf("Invalid PAGE_SIZE_CHARS 0: expected at least 1\n")
+	}
+	cfg.PageTTL = time.Duration(envInt("PAGE_TTL_MS", 300000)) * time.Millisecond
+	cfg.CannedAnswers = loadCannedAnswers()
+	cfg.CannedOnly = envBool("CANNED_ONLY")
+	cfg.PostProcessWebhookURL = os.Getenv("POST_PROCESS_WEBHOOK_URL")
+	cfg.PostProcessWebhookTimeout = time.Duration(envInt("POST_PROCESS_WEBHOOK_TIMEOUT_MS", 2000)) * time.Millisecond
+	cfg.MaxRequestDeadline = time.Duration(envInt("MAX_REQUEST_DEADLINE_MS", 120000)) * time.Millisecond
+	cfg.PriorityHighLimit = envInt("PRIORITY_HIGH_LIMIT", 0)
+	cfg.PriorityLowLimit = envInt("PRIORITY_LOW_LIMIT", 0)
+	cfg.Transliterate = envBool("TRANSLITERATE")
+	cfg.DebugEndpoints = envBool("DEBUG_ENDPOINTS")
+	if cfg.DebugRecentSize = envInt("DEBUG_RECENT_SIZE", 100); cfg.DebugRecentSize == 0 {
+		log.Fatalf("Invalid DEBUG_RECENT_SIZE 0: expected at least 1\n")
+	}
+	if cfg.DebugToken = os.Getenv("DEBUG_TOKEN"); cfg.DebugEndpoints && cfg.DebugToken == "" {
+		log.Fatalf("DEBUG_ENDPOINTS requires DEBUG_TOKEN\n")
+	}
+	cfg.UpstreamErrorAlertRate = envFloat("UPSTREAM_ERROR_ALERT_RATE", 0, 0, 1)
+	cfg.UpstreamErrorWindow = time.Duration(envInt("UPSTREAM_ERROR_WINDOW_MS", 60000)) * time.Millisecond
+}
+
+// envFloat returns the env var name as a float, or def when it is unset. It
+// exits on anything that isn't a number between min and max.
+func envFloat(name string, def, min, max float64) float64 {
+	raw := os.Getenv(name)
+	if raw == "" {
+		return def
+	}
+
+	f, err := strconv.ParseFloat(raw, 64)
+	if err != nil || f < min || f > max {
+		log.Fatalf("Invalid %s %q: expected a number between %g and %g\n", name, raw, min, max)
+	}
+	return f
+}
+
+// envList returns the comma-separated env var name as a list of lowercased,
+// trimmed values, using def when it is unset.
+func envList(name, def string) []string {
+	values := []string{}
+	for _, value := range strings.Split(envString(name, def), ",") {
+		if value = strings.ToLower(strings.TrimSpace(value)); value != "" {
+			values = append(values, value)
+		}
+	}
+	return values
+}
+
+// loadEmptyAnswerMode reads EMPTY_ANSWER_MODE, which is either "error" (the
+// default) or "allow".
+func loadEmptyAnswerMode() bool {
+	switch mode := envString("EMPTY_ANSWER_MODE", "error"); mode {
+	case "error":
+		return false
+	case "allow":
+		return true
+	default:
+		log.Fatalf("Invalid EMPTY_ANSWER_MODE %q: expected error or allow\n", mode)
+		return false
+	}
+}
+
+// loadEchoModelTransform reads ECHO_MODEL_TRANSFORM, which is none (the
+// default), upper or reverse.
+func loadEchoModelTransform() string {
+	switch transform := envString("ECHO_MODEL_TRANSFORM", "none"); transform {
+	case "none", "upper", "reverse":
+		return transform
+	default:
+		log.Fatalf("Invalid ECHO_MODEL_TRANSFORM %q: expected none, upper or reverse\n", transform)
+		return ""
+	}
+}
+
+// loadUpstreamRedirectPolicy reads UPSTREAM_REDIRECT_POLICY: "same-host"
+// (default) fails upstream calls redirected to another host, "follow" follows
+// them with the original headers.
+func loadUpstreamRedirectPolicy() string {
+	switch policy := envString("UPSTREAM_REDIRECT_POLICY", "same-host"); policy {
+	case "same-host", "follow":
+		return policy
+	default:
+		log.Fatalf("Invalid UPSTREAM_REDIRECT_POLICY %q: expected same-host or follow\n", policy)
+		return ""
+	}
+}
+
+// loadStatusRetries parses RETRY_CONFIG, a "status:retries,status2:retries"
+// list such as "429:5,503:2". Statuses must be 4xx or 5xx; anything else is
+// fatal.
+func loadStatusRetries() map[int]int {
+	retries := map[int]int{}
+	for _, entry := range strings.Split(os.Getenv("RETRY_CONFIG"), ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		rawStatus, rawCount, _ := strings.Cut(entry, ":")
+		status, err := strconv.Atoi(strings.TrimSpace(rawStatus))
+		if err != nil || status < 400 || status > 599 {
+			log.Fatalf("Invalid RETRY_CONFIG entry %q: expected status:retries with a 4xx or 5xx status\n", entry)
+		}
+		count, err := strconv.Atoi(strings.TrimSpace(rawCount))
+		if err != nil || count < 0 {
+			log.Fatalf("Invalid RETRY_CONFIG entry %q: expected a non-negative number of retries\n", entry)
+		}
+		retries[status] = count
+	}
+	return retries
+}
+
+// loadModelTimeouts parses MODEL_TIMEOUTS, a "model:ms,model2:ms" list. The
+// model names may contain ":" themselves, so each entry splits on the last
+// one. Anything but a positive number of milliseconds is fatal.
+func loadModelTimeouts() map[string]time.Duration {
+	timeouts := map[string]time.Duration{}
+	for _, entry := range strings.Split(os.Getenv("MODEL_TIMEOUTS"), ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		i := strings.LastIndex(entry, ":")
+		if i <= 0 {
+			log.Fatalf("Invalid MODEL_TIMEOUTS entry %q: expected model:ms\n", entry)
+		}
+		ms, err := strconv.Atoi(strings.TrimSpace(entry[i+1:]))
+		if err != nil || ms <= 0 {
+			log.Fatalf("Invalid MODEL_TIMEOUTS entry %q: expected a positive number of milliseconds\n", entry)
+		}
+		timeouts[strings.TrimSpace(entry[:i])] = time.Duration(ms) * time.Millisecond
+	}
+	return timeouts
+}
+
+// loadModelFallback reads ENABLE_MODEL_FALLBACK and FALLBACK_MODEL, exiting
+// when fallback is enabled without a model to fall back to.
+func loadModelFallback() (bool, string) {
+	enabled, model := envBool("ENABLE_MODEL_FALLBACK"), os.Getenv("FALLBACK_MODEL")
+	if enabled && model == "" {
+		log.Fatal("ENABLE_MODEL_FALLBACK requires FALLBACK_MODEL")
+	}
+	return enabled, model
+}
+
+// envString returns the env var name, or def when it is unset.
+func envString(name, def string) string {
+	if value := os.Getenv(name); value != "" {
+		return value
+	}
+	return def
+}
+
+// readEnvOrFile returns the env var name, or the contents of the file
+// named by name+"_FILE" when that is set. An unreadable file is fatal.
+func readEnvOrFile(name string) string {
+	path := os.Getenv(name + "_FILE")
+	if path == "" {
+		return os.Getenv(name)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		log.Fatalf("Error reading %s_FILE: %v\n", name, err)
+	}
+	return string(data)
+}
+
+// loadTLSFiles returns the TLS certificate and key paths, exiting when only
+// one of them is set or either file cannot be read.
+func loadTLSFiles() (certFile, keyFile string) {
+	certFile, keyFile = os.Getenv("TLS_CERT_FILE"), os.Getenv("TLS_KEY_FILE")
+	if certFile == "" && keyFile == "" {
+		return "", ""
+	}
+	if certFile == "" || keyFile == "" {
+		log.Fatal("TLS_CERT_FILE and TLS_KEY_FILE must be set together")
+	}
+
+	for _, path := range []string{certFile, keyFile} {
+		f, err := os.Open(path)
+		if err != nil {
+			log.Fatalf("Error opening TLS file: %v\n", err)
+		}
+		f.Close()
+	}
+	return certFile, keyFile
+}
+
+// envBool reports whether the env var name is set to a true value. It exits on
+// anything strconv.ParseBool does not accept.
+func envBool(name string) bool {
+	raw := os.Getenv(name)
+	if raw == "" {
+		return false
+	}
+
+	b, err := strconv.ParseBool(raw)
+	if err != nil {
+		log.Fatalf("Invalid %s %q: expected true or false\n", name, raw)
+	}
+	return b
+}
+
+// envInt returns the env var name as an integer, or def when it is unset. It
+// exits on anything that is not a non-negative integer.
+func envInt(name string, def int) int {
+	raw := os.Getenv(name)
+	if raw == "" {
+		return def
+	}
+
+	n, err := strconv.Atoi(raw)
+	if err != nil || n < 0 {
+		log.Fatalf("Invalid %s %q: expected a non-negative integer\n", name, raw)
+	}
+	return n
+}
+
+// loadAPIKeys reads the API key from the file named by NVIDIA_API_KEY_FILE,
+// as mounted by Docker and Kubernetes secrets, falling back to the
+// comma-separated NVIDIA_API_KEYS and then NVIDIA_API_KEY. An unreadable key
+// file is fatal.
+func loadAPIKeys() []string {
+	if path := os.Getenv("NVIDIA_API_KEY_FILE"); path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			log.Fatalf("Error reading NVIDIA_API_KEY_FILE: %v\n", err)
+		}
+		return []string{strings.TrimSpace(string(data))}
+	}
+
+	keys := []string{}
+	for _, key := range strings.Split(os.Getenv("NVIDIA_API_KEYS"), ",") {
+		if key = strings.TrimSpace(key); key != "" {
+			keys = append(keys, key)
+		}
+	}
+	if len(keys) > 0 {
+		return keys
+	}
+	return []string{os.Getenv("NVIDIA_API_KEY")}
+}
+
+// defaultBaseURL is the NVIDIA NIM API used when NVIDIA_BASE_URL is unset.
+const defaultBaseURL = "https://integrate.api.nvidia.com/v1"
+
+// loadAPIURL validates NVIDIA_BASE_URL and returns its chat completions
+// endpoint.
+func loadAPIURL() string {
+	return checkBaseURL("NVIDIA_BASE_URL", envString("NVIDIA_BASE_URL", defaultBaseURL)) + "/chat/completions"
+}
+
+// loadUpstreamEndpoints validates the base URLs in UPSTREAM_ENDPOINTS, one
+// per region, which replace NVIDIA_BASE_URL when set.
+func loadUpstreamEndpoints() []string {
+	bases := []string{}
+	for _, base := range strings.Split(os.Getenv("UPSTREAM_ENDPOINTS"), ",") {
+		if base = strings.TrimSpace(base); base != "" {
+			bases = append(bases, checkBaseURL("UPSTREAM_ENDPOINTS", base))
+		}
+	}
+	return bases
+}
+
+// checkBaseURL validates the base URL set in the env var name and returns it
+// without a trailing slash. An unusable URL is fatal; a host that doesn't
+// resolve only logs a warning, since DNS may come up after the server does.
+func checkBaseURL(name, base string) string {
+	u, err := url.Parse(base)
+	if err != nil {
+		log.Fatalf("Invalid %s %q: %v\n", name, base, err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		log.Fatalf("Invalid %s %q: scheme must be http or https\n", name, base)
+	}
+	if u.Hostname() == "" {
+		log.Fatalf("Invalid %s %q: missing host\n", name, base)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	if _, err := net.DefaultResolver.LookupHost(ctx, u.Hostname()); err != nil {
+		log.Printf("Warning: %s host %q does not resolve: %v\n", name, u.Hostname(), err)
+	}
+
+	return strings.TrimRight(base, "/")
+}
+
+// parseExtraHeaders parses a "Key1:Val1,Key2:Val2" list. Malformed entries are
+// skipped with a warning rather than failing startup.
+func parseExtraHeaders(raw string) map[string]string {
+	headers := map[string]string{}
+	for _, entry := range strings.Split(raw, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		key, value, ok := strings.Cut(entry, ":")
+		key = strings.TrimSpace(key)
+		if !ok || !isHeaderName(key) {
+			log.Printf("Skipping malformed UPSTREAM_EXTRA_HEADERS entry: %q\n", entry)
+			continue
+		}
+		headers[key] = strings.TrimSpace(value)
+	}
+	return headers
+}
+
+// parsePairList parses the env var name as a "from:to,from2:to2" list. A
+// malformed entry is fatal, since silently dropping it would change behavior
+// that was asked for.
+func parsePairList(name string) map[string]string {
+	pairs := map[string]string{}
+	for _, entry := range strings.Split(os.Getenv(name), ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		from, to, ok := strings.Cut(entry, ":")
+		from, to = strings.TrimSpace(from), strings.TrimSpace(to)
+		if !ok || from == "" || to == "" || from == to {
+			log.Fatalf("Invalid %s entry %q: expected from:to\n", name, entry)
+		}
+		pairs[from] = to
+	}
+	return pairs
+}
+
+// isHeaderName reports whether s is a valid HTTP header field name (an RFC 7230
+// token).
+func isHeaderName(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, r := range s {
+		isAlnum := ('0' <= r && r <= '9') || ('a' <= r && r <= 'z') || ('A' <= r && r <= 'Z')
+		if !isAlnum && !strings.ContainsRune("!#$%&'*+-.^_`|~", r) {
+			return false
+		}
+	}
+	return true
+}
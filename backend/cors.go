@@ -0,0 +1,55 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/middleware/cors"
+)
+
+// corsConfig is shared by the cors middleware and the explicit preflight
+// handler so the two always agree.
+var corsConfig = cors.Config{
+	AllowOrigins: "http://localhost:5173",
+	AllowMethods: "GET,POST,HEAD,PUT,DELETE,PATCH",
+	AllowHeaders: "Origin, Content-Type, Accept, X-Request-Deadline, X-Profile, X-Signature",
+}
+
+// defaultCORSExposeHeaders are the response headers of ours that browsers
+// let scripts read unless CORS_EXPOSE_HEADERS says otherwise.
+const defaultCORSExposeHeaders = "X-Request-ID, X-Model-Fallback, X-Model-Downgraded, X-Canned, X-Escalated, X-Short-Answer, X-Input-Truncated, X-Upstream-RateLimit-Remaining, X-Upstream-RateLimit-Reset, Server-Timing"
+
+// setupCORS applies CORS_EXPOSE_HEADERS and CORS_ALLOW_CREDENTIALS to
+// corsConfig once the config is loaded.
+func setupCORS() {
+	corsConfig.ExposeHeaders = cfg.CORSExposeHeaders
+	corsConfig.AllowCredentials = cfg.CORSAllowCredentials
+}
+
+// preflightHandler answers OPTIONS requests to /chat/ itself, whether or not
+// they carry Origin and Access-Control-Request-Method, rather than leaving
+// some to the cors middleware and the rest to the chat group's guards. It is
+// registered ahead of both and never touches the upstream.
+func preflightHandler(c *fiber.Ctx) error {
+	origin := strings.TrimRight(c.Get(fiber.HeaderOrigin), "/")
+	for _, allowed := range strings.Split(corsConfig.AllowOrigins, ",") {
+		allowed = strings.TrimRight(strings.TrimSpace(allowed), "/")
+		if allowed == "*" {
+			c.Set(fiber.HeaderAccessControlAllowOrigin, "*")
+			break
+		}
+		if origin != "" && strings.EqualFold(origin, allowed) {
+			c.Set(fiber.HeaderAccessControlAllowOrigin, origin)
+			break
+		}
+	}
+
+	c.Vary(fiber.HeaderOrigin)
+	c.Set(fiber.HeaderAccessControlAllowMethods, corsConfig.AllowMethods)
+	c.Set(fiber.HeaderAccessControlAllowHeaders, corsConfig.AllowHeaders)
+	if corsConfig.AllowCredentials {
+		c.Set(fiber.HeaderAccessControlAllowCredentials, "true")
+	}
+	return c.SendStatus(http.StatusNoContent)
+}
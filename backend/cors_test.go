@@ -0,0 +1,121 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+func TestCORS(t *testing.T) {
+	const allowed, disallowed = "http://localhost:5173", "http://evil.example"
+	tests := []struct {
+		name            string
+		method          string
+		origin          string
+		credentials     string
+		wantOrigin      string
+		wantCredentials string
+		wantExposed     bool
+	}{
+		{"POST from allowed origin", http.MethodPost, allowed, "", allowed, "", true},
+		{"POST from disallowed origin", http.MethodPost, disallowed, "", "", "", false},
+		{"POST with credentials", http.MethodPost, allowed, "true", allowed, "true", true},
+		{"preflight from allowed origin", http.MethodOptions, allowed, "", allowed, "", false},
+		{"preflight from disallowed origin", http.MethodOptions, disallowed, "", "", "", false},
+		{"preflight with credentials", http.MethodOptions, allowed, "true", allowed, "true", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApp(t, answerWith("hello"), map[string]string{"CORS_ALLOW_CREDENTIALS": tt.credentials})
+			req := httptest.NewRequest(tt.method, "/chat/", strings.NewReader(`{"question": "hello"}`))
+			req.Header.Set("Content-Type", "application/json")
+			req.Header.Set(fiber.HeaderOrigin, tt.origin)
+			resp, err := app.Test(req, -1)
+			if err != nil {
+				t.Fatalf("app.Test: %v", err)
+			}
+			resp.Body.Close()
+
+			if got := resp.Header.Get(fiber.HeaderAccessControlAllowOrigin); got != tt.wantOrigin {
+				t.Errorf("Access-Control-Allow-Origin = %q, want %q", got, tt.wantOrigin)
+			}
+			if got := resp.Header.Get(fiber.HeaderAccessControlAllowCredentials); got != tt.wantCredentials {
+				t.Errorf("Access-Control-Allow-Credentials = %q, want %q", got, tt.wantCredentials)
+			}
+			// Without a matching Allow-Origin the browser ignores the
+			// exposed headers, so they only matter for allowed origins
+			exposed := resp.Header.Get(fiber.HeaderAccessControlExposeHeaders)
+			if tt.wantExposed && !(strings.Contains(exposed, "X-Request-ID") && strings.Contains(exposed, "Server-Timing")) {
+				t.Errorf("Access-Control-Expose-Headers = %q, want the defaults", exposed)
+			}
+		})
+	}
+}
+
+// TestPreflightAllowsRequestHeaders checks browsers may send the custom
+// request headers the API reads.
+func TestPreflightAllowsRequestHeaders(t *testing.T) {
+	app := newTestApp(t, answerWith("hello"), nil)
+	for _, preflight := range []map[string]string{
+		{fiber.HeaderOrigin: "http://localhost:5173"},
+		{fiber.HeaderOrigin: "http://localhost:5173", fiber.HeaderAccessControlRequestMethod: http.MethodPost},
+	} {
+		req := httptest.NewRequest(http.MethodOptions, "/chat/", nil)
+		for key, value := range preflight {
+			req.Header.Set(key, value)
+		}
+		resp, err := app.Test(req, -1)
+		if err != nil {
+			t.Fatalf("app.Test: %v", err)
+		}
+		resp.Body.Close()
+
+		allowed := strings.ToLower(resp.Header.Get(fiber.HeaderAccessControlAllowHeaders))
+		for _, header := range []string{"X-Profile", "X-Request-Deadline", "X-Signature"} {
+			if !strings.Contains(allowed, strings.ToLower(header)) {
+				t.Errorf("preflight %v: Access-Control-Allow-Headers = %q, missing %s", preflight, allowed, header)
+			}
+		}
+	}
+}
+
+// TestChatPreflight checks OPTIONS /chat/ gets a 204 with the allowed
+// methods and headers without reaching the upstream.
+func TestChatPreflight(t *testing.T) {
+	var upstreamCalls atomic.Int32
+	app := newTestApp(t, func(w http.ResponseWriter, r *http.Request) {
+		upstreamCalls.Add(1)
+		writeCompletion(w, "hello")
+	}, nil)
+	for _, path := range []string{"/chat/", "/chat"} {
+		req := httptest.NewRequest(http.MethodOptions, path, nil)
+		req.Header.Set(fiber.HeaderOrigin, "http://localhost:5173")
+		req.Header.Set(fiber.HeaderAccessControlRequestMethod, http.MethodPost)
+		req.Header.Set(fiber.HeaderAccessControlRequestHeaders, "Content-Type, X-Profile")
+		resp, err := app.Test(req, -1)
+		if err != nil {
+			t.Fatalf("app.Test: %v", err)
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode != http.StatusNoContent {
+			t.Errorf("%s: status = %d, want 204", path, resp.StatusCode)
+		}
+		if got := resp.Header.Get(fiber.HeaderAccessControlAllowOrigin); got != "http://localhost:5173" {
+			t.Errorf("%s: Access-Control-Allow-Origin = %q", path, got)
+		}
+		if got := resp.Header.Get(fiber.HeaderAccessControlAllowMethods); !strings.Contains(got, http.MethodPost) {
+			t.Errorf("%s: Access-Control-Allow-Methods = %q, missing POST", path, got)
+		}
+		if got := resp.Header.Get(fiber.HeaderAccessControlAllowHeaders); got != corsConfig.AllowHeaders {
+			t.Errorf("%s: Access-Control-Allow-Headers = %q, want %q", path, got, corsConfig.AllowHeaders)
+		}
+	}
+	if n := upstreamCalls.Load(); n != 0 {
+		t.Errorf("upstream called %d times", n)
+	}
+}
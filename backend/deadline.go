@@ -0,0 +1,49 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// requestDeadline bounds the request's context by the client's
+// X-Request-Deadline, an RFC 3339 time after which it won't wait for the
+// answer, so no upstream work continues past it. The deadline is clamped to
+// MAX_REQUEST_DEADLINE_MS from now; one already past is rejected up front.
+func requestDeadline(c *fiber.Ctx) error {
+	raw := c.Get("X-Request-Deadline")
+	if raw == "" {
+		return c.Next()
+	}
+
+	deadline, err := time.Parse(time.RFC3339, raw)
+	if err != nil {
+		return errorResponse(c, badRequest("Invalid X-Request-Deadline, expected an RFC 3339 time"))
+	}
+	now := time.Now()
+	if !deadline.After(now) {
+		return errorResponse(c, &apiError{
+			Status:  http.StatusBadRequest,
+			Message: "X-Request-Deadline has already passed",
+			Code:    "deadline_passed",
+		})
+	}
+	if limit := now.Add(cfg.MaxRequestDeadline); cfg.MaxRequestDeadline > 0 && deadline.After(limit) {
+		deadline = limit
+	}
+
+	ctx, cancel := context.WithDeadline(c.UserContext(), deadline)
+	defer cancel()
+	c.SetUserContext(ctx)
+	return c.Next()
+}
+
+// errDeadlinePassed is returned when the client's X-Request-Deadline runs out
+// during an upstream call.
+var errDeadlinePassed = &apiError{
+	Status:  http.StatusGatewayTimeout,
+	Message: "X-Request-Deadline passed before the upstream answered",
+	Code:    "deadline_passed",
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/utils"
+)
+
+// recentRequest is what GET /debug/recent shows about one /chat request. The
+// question is only kept as a hash.
+type recentRequest struct {
+	Timestamp time.Time              `json:"timestamp"`
+	RequestID string                 `json:"request_id"`
+	Path      string                 `json:"path"`
+	Status    int                    `json:"status"`
+	LatencyMs int64                  `json:"latency_ms"`
+	Model     string                 `json:"model,omitempty"`
+	Usage     map[string]interface{} `json:"usage,omitempty"`
+	Question  string                 `json:"question,omitempty"`
+}
+
+// recentRequests holds the last DEBUG_RECENT_SIZE requests in a ring buffer.
+var recentRequests = struct {
+	sync.Mutex
+	entries []recentRequest
+	next    int
+}{}
+
+// recentLocal is the Locals key under which recordRecent leaves the entry
+// for the handler to fill in.
+const recentLocal = "recent"
+
+// recordRecent keeps the outcome of each request in recentRequests when
+// DEBUG_ENDPOINTS is on.
+func recordRecent(c *fiber.Ctx) error {
+	if !cfg.DebugEndpoints {
+		return c.Next()
+	}
+
+	// Fiber reuses the memory behind c.Path() once the request is done, so
+	// the entry, which outlives it, keeps a copy
+	start := time.Now()
+	entry := &recentRequest{
+		Timestamp: start,
+		RequestID: fmt.Sprint(c.Locals("requestid")),
+		Path:      utils.CopyString(c.Path()),
+	}
+	c.Locals(recentLocal, entry)
+
+	err := c.Next()
+
+	entry.Status = c.Response().StatusCode()
+	if err != nil {
+		entry.Status = http.StatusInternalServerError
+		if fiberErr, ok := err.(*fiber.Error); ok {
+			entry.Status = fiberErr.Code
+		}
+	}
+	entry.LatencyMs = time.Since(start).Milliseconds()
+
+	recentRequests.Lock()
+	if len(recentRequests.entries) < cfg.DebugRecentSize {
+		recentRequests.entries = append(recentRequests.entries, *entry)
+	} else {
+		recentRequests.entries[recentRequests.next] = *entry
+	}
+	recentRequests.next = (recentRequests.next + 1) % cfg.DebugRecentSize
+	recentRequests.Unlock()
+	return err
+}
+
+// noteRecent adds what the handler learned about the request to the entry
+// recordRecent is keeping for it, if any.
+func noteRecent(c *fiber.Ctx, question string, result *completion) {
+	entry, ok := c.Locals(recentLocal).(*recentRequest)
+	if !ok {
+		return
+	}
+	entry.Question = redact(question)
+	if result != nil {
+		entry.Model = result.Model
+		entry.Usage = result.Usage
+	}
+}
+
+// debugRecentHandler returns the recorded requests, newest first, to a
+// caller sending DEBUG_TOKEN as a bearer token.
+func debugRecentHandler(c *fiber.Ctx) error {
+	want := "Bearer " + cfg.DebugToken
+	if cfg.DebugToken == "" || subtle.ConstantTimeCompare([]byte(c.Get(fiber.HeaderAuthorization)), []byte(want)) != 1 {
+		return c.Status(http.StatusUnauthorized).JSON(fiber.Map{
+			"error": "Invalid or missing debug token",
+		})
+	}
+
+	recentRequests.Lock()
+	entries := make([]recentRequest, 0, len(recentRequests.entries))
+	for i := 1; i <= len(recentRequests.entries); i++ {
+		index := (recentRequests.next - i + len(recentRequests.entries)) % len(recentRequests.entries)
+		entries = append(entries, recentRequests.entries[index])
+	}
+	recentRequests.Unlock()
+
+	return c.JSON(fiber.Map{"requests": entries})
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestDebugRecentToken(t *testing.T) {
+	app := newTestApp(t, answerWith("hello"), map[string]string{
+		"DEBUG_ENDPOINTS": "true",
+		"DEBUG_TOKEN":     "secret",
+	})
+	tests := []struct {
+		name          string
+		authorization string
+		wantStatus    int
+	}{
+		{"missing", "", http.StatusUnauthorized},
+		{"wrong", "Bearer guess", http.StatusUnauthorized},
+		{"right", "Bearer secret", http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/debug/recent", nil)
+			if tt.authorization != "" {
+				req.Header.Set("Authorization", tt.authorization)
+			}
+			if status, body := doRequest(t, app, req); status != tt.wantStatus {
+				t.Errorf("got %d %v, want %d", status, body, tt.wantStatus)
+			}
+		})
+	}
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// endpointLatencyWeight is how much each new latency counts in an
+// endpoint's moving average.
+const endpointLatencyWeight = 0.3
+
+// endpointProbeTimeout bounds one health probe.
+const endpointProbeTimeout = 5 * time.Second
+
+// endpoint is one upstream region. Calls go to the healthy endpoint with the
+// lowest latencyEWMA; one never measured yet counts as fastest so it gets
+// measured.
+type endpoint struct {
+	apiURL   string
+	probeURL string
+
+	mu          sync.Mutex
+	latencyEWMA float64 // milliseconds
+	measured    bool
+	healthy     bool
+}
+
+// endpoints are the upstream regions from UPSTREAM_ENDPOINTS, or just
+// NVIDIA_BASE_URL, set up by setupEndpoints.
+var endpoints []*endpoint
+
+// setupEndpoints builds endpoints once the config is loaded and, when
+// there are several, probes them every UPSTREAM_PROBE_INTERVAL_MS.
+func setupEndpoints() {
+	if len(cfg.UpstreamEndpoints) == 0 {
+		endpoints = []*endpoint{{apiURL: cfg.APIURL, healthy: true}}
+		return
+	}
+
+	for _, base := range cfg.UpstreamEndpoints {
+		endpoints = append(endpoints, &endpoint{
+			apiURL:   base + "/chat/completions",
+			probeURL: base + "/models",
+			healthy:  true,
+		})
+	}
+	if cfg.UpstreamProbeInterval == 0 {
+		return
+	}
+	go func() {
+		for range time.Tick(cfg.UpstreamProbeInterval) {
+			for _, e := range endpoints {
+				e.probe()
+			}
+		}
+	}()
+}
+
+// rankedEndpoints returns the endpoints in the order to try them: healthy
+// ones fastest first, then the unhealthy ones as a last resort.
+func rankedEndpoints() []*endpoint {
+	type ranked struct {
+		e           *endpoint
+		healthy     bool
+		latencyEWMA float64
+	}
+	order := make([]ranked, len(endpoints))
+	for i, e := range endpoints {
+		e.mu.Lock()
+		order[i] = ranked{e, e.healthy, e.latencyEWMA}
+		e.mu.Unlock()
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		if order[i].healthy != order[j].healthy {
+			return order[i].healthy
+		}
+		return order[i].latencyEWMA < order[j].latencyEWMA
+	})
+
+	sorted := make([]*endpoint, len(order))
+	for i, r := range order {
+		sorted[i] = r.e
+	}
+	return sorted
+}
+
+// record folds the outcome of a call or probe into the endpoint's health
+// and, when it succeeded, its latency average.
+func (e *endpoint) record(latency time.Duration, ok bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if ok != e.healthy && len(endpoints) > 1 {
+		if ok {
+			log.Printf("Upstream endpoint %s is healthy again\n", e.apiURL)
+		} else {
+			log.Printf("Upstream endpoint %s is unhealthy, preferring the others\n", e.apiURL)
+		}
+	}
+	e.healthy = ok
+	if !ok {
+		return
+	}
+
+	ms := float64(latency) / float64(time.Millisecond)
+	if !e.measured {
+		e.latencyEWMA, e.measured = ms, true
+		return
+	}
+	e.latencyEWMA = endpointLatencyWeight*ms + (1-endpointLatencyWeight)*e.latencyEWMA
+}
+
+// probe checks that the endpoint answers without a server error.
+func (e *endpoint) probe() {
+	ctx, cancel := context.WithTimeout(context.Background(), endpointProbeTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, e.probeURL, nil)
+	if err != nil {
+		log.Printf("Error creating probe for %s: %v\n", e.probeURL, err)
+		return
+	}
+	_, apiKey := cfg.APIKeys.pick()
+	req.Header.Set("Authorization", "Bearer "+apiKey)
+
+	start := time.Now()
+	resp, err := upstreamClient.Do(req)
+	if err != nil {
+		log.Printf("Error probing upstream endpoint %s: %v\n", e.probeURL, err)
+		e.record(0, false)
+		return
+	}
+	resp.Body.Close()
+	e.record(time.Since(start), resp.StatusCode < http.StatusInternalServerError)
+}
+
+// shouldFailOver reports whether err, from a call to one endpoint, is worth
+// retrying on the next: the endpoint couldn't be reached or answered with a
+// 5xx. Errors of our own making (a body that won't render, an answer that
+// won't parse) would fail the same way everywhere, and a client that has
+// gone needs no answer.
+func shouldFailOver(ctx context.Context, err error) bool {
+	var apiErr *apiError
+	return ctx.Err() == nil && errors.As(err, &apiErr) &&
+		(apiErr.transportFailed || apiErr.upstreamStatus >= http.StatusInternalServerError)
+}
+
+// answeredByEndpoint reports whether a call that didn't fail over got an
+// answer from the endpoint, a success or an upstream error status, so its
+// latency says something about the endpoint.
+func answeredByEndpoint(err error) bool {
+	var apiErr *apiError
+	return err == nil || (errors.As(err, &apiErr) && apiErr.upstreamStatus != 0)
+}
+
+// endpointStats reports each endpoint's health and latency average for
+// /stats, when there are several.
+func endpointStats() []map[string]interface{} {
+	stats := []map[string]interface{}{}
+	for _, e := range endpoints {
+		e.mu.Lock()
+		stats = append(stats, map[string]interface{}{
+			"url":             e.apiURL,
+			"healthy":         e.healthy,
+			"latency_ewma_ms": e.latencyEWMA,
+		})
+		e.mu.Unlock()
+	}
+	return stats
+}
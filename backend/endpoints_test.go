@@ -0,0 +1,67 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+)
+
+func TestEndpointFailover(t *testing.T) {
+	tests := []struct {
+		name          string
+		first         http.HandlerFunc
+		wantStatus    int
+		wantSecond    int64
+		wantUnhealthy bool
+	}{
+		{
+			name:          "upstream 5xx fails over",
+			first:         func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusServiceUnavailable) },
+			wantStatus:    http.StatusOK,
+			wantSecond:    1,
+			wantUnhealthy: true,
+		},
+		{
+			name:       "unparseable answer stays put",
+			first:      func(w http.ResponseWriter, r *http.Request) { w.Write([]byte("not json")) },
+			wantStatus: http.StatusInternalServerError,
+		},
+		{
+			name:       "upstream 4xx stays put",
+			first:      func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusBadRequest) },
+			wantStatus: http.StatusBadRequest,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			first := httptest.NewServer(tt.first)
+			defer first.Close()
+			var secondCalls atomic.Int64
+			second := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				secondCalls.Add(1)
+				writeCompletion(w, "from the second region")
+			}))
+			defer second.Close()
+
+			app := newTestApp(t, answerWith("unused"), map[string]string{
+				"UPSTREAM_ENDPOINTS":         first.URL + "/v1," + second.URL + "/v1",
+				"UPSTREAM_PROBE_INTERVAL_MS": "0",
+			})
+			status, body := postChat(t, app, "/chat/", `{"question": "hello"}`)
+
+			if status != tt.wantStatus {
+				t.Errorf("status = %d %v, want %d", status, body, tt.wantStatus)
+			}
+			if got := secondCalls.Load(); got != tt.wantSecond {
+				t.Errorf("second region called %d times, want %d", got, tt.wantSecond)
+			}
+			if unhealthy := !endpoints[0].healthy; unhealthy != tt.wantUnhealthy {
+				t.Errorf("first region unhealthy = %v, want %v", unhealthy, tt.wantUnhealthy)
+			}
+			if !endpoints[1].healthy {
+				t.Error("second region marked unhealthy")
+			}
+		})
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"unicode/utf8"
+)
+
+// defaultEscalationPhrases mark an answer where the cheap model gave up or
+// hedged.
+const defaultEscalationPhrases = "i don't know,i do not know,i'm not sure,i am not sure,i cannot help,i can't help,i'm unable to,i am unable to"
+
+// startCheap points payload at ESCALATION_CHEAP_MODEL under
+// ENABLE_ESCALATION, unless the request or its profile picked a model. It
+// reports whether it did, and so whether the answer may be escalated.
+func startCheap(payload map[string]interface{}, req *chatRequest) bool {
+	if !cfg.EnableEscalation || req.Model != "" || (req.Profile != nil && req.Profile.Model != "") {
+		return false
+	}
+	payload["model"] = cfg.EscalationCheapModel
+	return true
+}
+
+// needsEscalation reports why answer from the cheap model should be asked
+// again of ESCALATION_MODEL: it is shorter than ESCALATION_MIN_CHARS or
+// contains one of ESCALATION_PHRASES.
+func needsEscalation(answer string) (reason string, escalate bool) {
+	if size := utf8.RuneCountInString(strings.TrimSpace(answer)); size < cfg.EscalationMinChars {
+		return fmt.Sprintf("answer is %d characters", size), true
+	}
+	lower := strings.ToLower(answer)
+	for _, phrase := range cfg.EscalationPhrases {
+		if strings.Contains(lower, phrase) {
+			return fmt.Sprintf("answer says %q", phrase), true
+		}
+	}
+	return "", false
+}
+
+// loadEscalationModels reads the cheap and expensive models
+// ENABLE_ESCALATION needs.
+func loadEscalationModels() (bool, string, string) {
+	enabled := envBool("ENABLE_ESCALATION")
+	cheap, expensive := envString("ESCALATION_CHEAP_MODEL", ""), envString("ESCALATION_MODEL", "")
+	if enabled && (cheap == "" || expensive == "") {
+		log.Fatal("ENABLE_ESCALATION requires ESCALATION_CHEAP_MODEL and ESCALATION_MODEL")
+	}
+	return enabled, cheap, expensive
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// chatEvent is published to NATS after each successful chat so downstream
+// systems can consume it for analytics or indexing.
+type chatEvent struct {
+	RequestID string                 `json:"request_id"`
+	Question  string                 `json:"question"`
+	Answer    string                 `json:"answer"`
+	Model     string                 `json:"model"`
+	Usage     map[string]interface{} `json:"usage,omitempty"`
+	LatencyMs int64                  `json:"latency_ms"`
+	Metadata  map[string]string      `json:"metadata,omitempty"`
+	Timestamp time.Time              `json:"timestamp"`
+}
+
+// natsConn is nil unless NATS_URL is set.
+var natsConn *nats.Conn
+
+// connectNATS connects to NATS_URL. The connection is retried in the
+// background, so a broker that is down at startup doesn't stop the server.
+func connectNATS() {
+	if cfg.NATSURL == "" {
+		return
+	}
+
+	conn, err := nats.Connect(cfg.NATSURL,
+		nats.Name("chatbot-backend"),
+		nats.RetryOnFailedConnect(true),
+		nats.MaxReconnects(-1),
+	)
+	if err != nil {
+		log.Printf("Error connecting to NATS: %v\n", err)
+		return
+	}
+	log.Printf("Publishing chat events to NATS subject %q\n", cfg.NATSSubject)
+	natsConn = conn
+}
+
+// publishChatEvent publishes event without blocking the request. Failures are
+// logged and otherwise ignored.
+func publishChatEvent(event chatEvent) {
+	if natsConn == nil {
+		return
+	}
+
+	data, err := json.Marshal(event)
+	if err != nil {
+		log.Printf("Error encoding chat event: %v\n", err)
+		return
+	}
+	if err := natsConn.Publish(cfg.NATSSubject, data); err != nil {
+		log.Printf("Error publishing chat event: %v\n", err)
+	}
+}
@@ -0,0 +1,27 @@
+package main
+
+import (
+	"net/http"
+	"sync/atomic"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// shuttingDown is set at the start of graceful shutdown so readiness checks
+// fail while in-flight requests drain.
+var shuttingDown atomic.Bool
+
+// healthHandler is the liveness check: it answers 200 for as long as the
+// process is serving at all.
+func healthHandler(c *fiber.Ctx) error {
+	return c.JSON(fiber.Map{"status": "ok"})
+}
+
+// readyHandler is the readiness check. It answers 503 once shutdown has
+// started, so load balancers stop routing new traffic here.
+func readyHandler(c *fiber.Ctx) error {
+	if shuttingDown.Load() {
+		return c.Status(http.StatusServiceUnavailable).JSON(fiber.Map{"status": "shutting down"})
+	}
+	return c.JSON(fiber.Map{"status": "ok"})
+}
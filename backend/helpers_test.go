@@ -0,0 +1,86 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// newTestApp loads the config from env, with the upstream pointed at an
+// httptest server running upstream, and returns the app.
+func newTestApp(t *testing.T, upstream http.HandlerFunc, env map[string]string) *fiber.App {
+	t.Helper()
+	server := httptest.NewServer(upstream)
+	t.Cleanup(server.Close)
+
+	t.Setenv("NVIDIA_BASE_URL", server.URL+"/v1")
+	t.Setenv("NVIDIA_API_KEY", "test-key")
+	for name, value := range env {
+		t.Setenv(name, value)
+	}
+
+	cfg = config{}
+	loadConfig()
+	setupUpstreamClient()
+	endpoints = nil
+	setupEndpoints()
+	setupCORS()
+	setupLanes()
+	return NewApp()
+}
+
+// answerWith is an upstream that answers every call with answer.
+func answerWith(answer string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		writeCompletion(w, answer)
+	}
+}
+
+// writeCompletion writes an OpenAI-shaped chat completion holding answer.
+func writeCompletion(w http.ResponseWriter, answer string) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"model": defaultModel,
+		"choices": []interface{}{map[string]interface{}{
+			"finish_reason": "stop",
+			"message":       map[string]interface{}{"role": "assistant", "content": answer},
+		}},
+		"usage": map[string]interface{}{"prompt_tokens": 5, "completion_tokens": 3},
+	})
+}
+
+// postChat sends body to path as JSON and returns the status and decoded
+// response body.
+func postChat(t *testing.T, app *fiber.App, path, body string) (int, map[string]interface{}) {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	return doRequest(t, app, req)
+}
+
+// doRequest runs req through app and returns the status and decoded JSON
+// response body.
+func doRequest(t *testing.T, app *fiber.App, req *http.Request) (int, map[string]interface{}) {
+	t.Helper()
+	resp, err := app.Test(req, -1)
+	if err != nil {
+		t.Fatalf("app.Test: %v", err)
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("reading response body: %v", err)
+	}
+	var decoded map[string]interface{}
+	if len(data) > 0 {
+		if err := json.Unmarshal(data, &decoded); err != nil {
+			t.Fatalf("decoding response body %q: %v", data, err)
+		}
+	}
+	return resp.StatusCode, decoded
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"bytes"
+	"regexp"
+
+	"github.com/microcosm-cc/bluemonday"
+	"github.com/yuin/goldmark"
+	"github.com/yuin/goldmark/extension"
+)
+
+// markdown renders answers with GitHub-flavoured Markdown (tables, fenced
+// code, strikethrough, autolinks). Raw HTML in the answer is left out of the
+// output.
+var markdown = goldmark.New(goldmark.WithExtensions(extension.GFM))
+
+// htmlPolicy sanitizes rendered answers: it keeps formatting, links and the
+// language class on code blocks, and drops scripts, styles, event handlers
+// and anything else that could run in the page showing the answer.
+var htmlPolicy = func() *bluemonday.Policy {
+	policy := bluemonday.UGCPolicy()
+	policy.AllowAttrs("class").Matching(regexp.MustCompile(`^language-[\w+#-]+$`)).OnElements("code")
+	return policy
+}()
+
+// renderAnswerHTML converts a Markdown answer to sanitized HTML for requests
+// with "format": "html".
+func renderAnswerHTML(answer string) (string, error) {
+	var b bytes.Buffer
+	if err := markdown.Convert([]byte(answer), &b); err != nil {
+		return "", err
+	}
+	return htmlPolicy.Sanitize(b.String()), nil
+}
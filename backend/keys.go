@@ -0,0 +1,59 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// keyPool hands out API keys round-robin, skipping keys benched after a 429
+// until their cooldown has passed.
+type keyPool struct {
+	mu           sync.Mutex
+	keys         []string
+	benchedUntil []time.Time
+	next         int
+	cooldown     time.Duration
+}
+
+func newKeyPool(keys []string, cooldown time.Duration) *keyPool {
+	return &keyPool{
+		keys:         keys,
+		benchedUntil: make([]time.Time, len(keys)),
+		cooldown:     cooldown,
+	}
+}
+
+// pick returns the next key that isn't benched and its index. When every key
+// is benched it returns the one whose cooldown ends first, rather than
+// failing the request outright.
+func (p *keyPool) pick() (index int, key string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := time.Now()
+	soonest := p.next
+	for i := 0; i < len(p.keys); i++ {
+		candidate := (p.next + i) % len(p.keys)
+		if !now.Before(p.benchedUntil[candidate]) {
+			p.next = (candidate + 1) % len(p.keys)
+			return candidate, p.keys[candidate]
+		}
+		if p.benchedUntil[candidate].Before(p.benchedUntil[soonest]) {
+			soonest = candidate
+		}
+	}
+	p.next = (soonest + 1) % len(p.keys)
+	return soonest, p.keys[soonest]
+}
+
+// bench takes the key at index out of rotation for the pool's cooldown.
+func (p *keyPool) bench(index int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.benchedUntil[index] = time.Now().Add(p.cooldown)
+}
+
+// size returns the number of keys in the pool.
+func (p *keyPool) size() int {
+	return len(p.keys)
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"sync/atomic"
+)
+
+// Request priorities. Interactive requests are "high"; batch clients can
+// send "low" so their work queues separately and can't hold up users.
+const (
+	priorityHigh = "high"
+	priorityLow  = "low"
+)
+
+// lane caps the upstream calls in flight for one priority. A nil slots
+// channel means no cap.
+type lane struct {
+	slots    chan struct{}
+	inFlight atomic.Int64
+	waiting  atomic.Int64
+}
+
+var lanes = map[string]*lane{}
+
+// setupLanes builds the lanes from PRIORITY_HIGH_LIMIT and PRIORITY_LOW_LIMIT
+// once the config is loaded.
+func setupLanes() {
+	lanes[priorityHigh] = newLane(cfg.PriorityHighLimit)
+	lanes[priorityLow] = newLane(cfg.PriorityLowLimit)
+}
+
+func newLane(limit int) *lane {
+	l := &lane{}
+	if limit > 0 {
+		l.slots = make(chan struct{}, limit)
+	}
+	return l
+}
+
+// parsePriority validates a request's "priority", defaulting to high.
+func parsePriority(priority string) (string, bool) {
+	switch priority {
+	case "":
+		return priorityHigh, true
+	case priorityHigh, priorityLow:
+		return priority, true
+	}
+	return "", false
+}
+
+var errInvalidPriority = badRequest("Invalid priority, expected %q or %q", priorityHigh, priorityLow)
+
+// priorityKey carries a request's priority in its context.
+type priorityKey struct{}
+
+// withPriority returns ctx marked with the request's priority.
+func withPriority(ctx context.Context, priority string) context.Context {
+	return context.WithValue(ctx, priorityKey{}, priority)
+}
+
+// errClientCanceled is returned when the client goes away while its call
+// waits for a lane slot. Nobody reads the response, so the status, nginx's
+// 499, is only there to tell it apart from a queue timeout in the logs.
+var errClientCanceled = &apiError{
+	Status:  499,
+	Message: "Client closed the request while waiting for a free upstream slot",
+	Code:    "client_canceled",
+}
+
+// acquireLane waits for a free upstream slot in the lane of ctx's priority
+// and returns the function that frees it. It gives up when ctx is done: a
+// deadline that passed is a queue timeout, a client that went away isn't.
+func acquireLane(ctx context.Context) (release func(), err error) {
+	priority, _ := ctx.Value(priorityKey{}).(string)
+	l, ok := lanes[priority]
+	if !ok {
+		l = lanes[priorityHigh]
+	}
+
+	if l.slots != nil {
+		l.waiting.Add(1)
+		select {
+		case l.slots <- struct{}{}:
+			l.waiting.Add(-1)
+		case <-ctx.Done():
+			l.waiting.Add(-1)
+			if errors.Is(ctx.Err(), context.Canceled) {
+				log.Printf("Client went away while waiting for a free %s upstream slot\n", priority)
+				return nil, errClientCanceled
+			}
+			return nil, &apiError{
+				Status:  http.StatusServiceUnavailable,
+				Message: "Gave up waiting for a free upstream slot",
+				Code:    "queue_timeout",
+			}
+		}
+	}
+	l.inFlight.Add(1)
+
+	return func() {
+		l.inFlight.Add(-1)
+		if l.slots != nil {
+			<-l.slots
+		}
+	}, nil
+}
+
+// laneStats reports each lane's in-flight and waiting upstream calls for
+// /stats.
+func laneStats() map[string]interface{} {
+	stats := map[string]interface{}{}
+	for priority, l := range lanes {
+		stats[priority] = map[string]int64{
+			"in_flight": l.inFlight.Load(),
+			"waiting":   l.waiting.Load(),
+		}
+	}
+	return stats
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestAcquireLaneGivingUp(t *testing.T) {
+	newTestApp(t, answerWith("hello"), map[string]string{"PRIORITY_HIGH_LIMIT": "1"})
+	release, err := acquireLane(withPriority(context.Background(), priorityHigh))
+	if err != nil {
+		t.Fatalf("acquiring the free slot: %v", err)
+	}
+	defer release()
+
+	canceled, cancel := context.WithCancel(withPriority(context.Background(), priorityHigh))
+	cancel()
+	expired, cancelExpired := context.WithTimeout(withPriority(context.Background(), priorityHigh), time.Millisecond)
+	defer cancelExpired()
+
+	tests := []struct {
+		name     string
+		ctx      context.Context
+		wantCode string
+	}{
+		{"client went away", canceled, "client_canceled"},
+		{"deadline passed", expired, "queue_timeout"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := acquireLane(tt.ctx)
+			var apiErr *apiError
+			if !errors.As(err, &apiErr) || apiErr.Code != tt.wantCode {
+				t.Errorf("got %v, want code %s", err, tt.wantCode)
+			}
+		})
+	}
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/abadojack/whatlanggo"
+)
+
+// lookupLanguage resolves a requested language given as an English name
+// ("Spanish"), an ISO 639-1 code ("es") or an ISO 639-3 code ("spa").
+func lookupLanguage(name string) (whatlanggo.Lang, bool) {
+	name = strings.ToLower(strings.TrimSpace(name))
+	for lang := whatlanggo.Afr; lang <= whatlanggo.Zul; lang++ {
+		if name == strings.ToLower(lang.String()) || name == lang.Iso6391() || name == lang.Iso6393() {
+			return lang, true
+		}
+	}
+	return 0, false
+}
+
+// answerInLanguage reports whether answer appears to be written in want.
+// Detections below the library's reliability threshold count as a match, since
+// short or code-heavy answers are easily misclassified.
+func answerInLanguage(answer string, want whatlanggo.Lang) (whatlanggo.Lang, bool) {
+	info := whatlanggo.Detect(answer)
+	if !info.IsReliable() {
+		return info.Lang, true
+	}
+	return info.Lang, info.Lang == want
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"log"
+	"sync/atomic"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+var (
+	// upstreamInFlight is the number of upstream calls currently waiting on
+	// the API.
+	upstreamInFlight atomic.Int64
+
+	// modelDowngrades counts requests sent to a cheaper model under load.
+	modelDowngrades atomic.Int64
+)
+
+// downgradeForLoad swaps payload's model for its DOWNGRADE_MODELS
+// replacement when DOWNGRADE_THRESHOLD or more upstream calls are in flight,
+// trading answer quality for latency during spikes. It reports whether the
+// model was swapped.
+func downgradeForLoad(payload map[string]interface{}) bool {
+	if cfg.DowngradeThreshold == 0 {
+		return false
+	}
+	model, _ := payload["model"].(string)
+	cheaper, ok := cfg.DowngradeModels[model]
+	if !ok {
+		return false
+	}
+	inFlight := upstreamInFlight.Load()
+	if inFlight < int64(cfg.DowngradeThreshold) {
+		return false
+	}
+
+	log.Printf("Downgrading %s to %s with %d upstream calls in flight\n", model, cheaper, inFlight)
+	payload["model"] = cheaper
+	return true
+}
+
+// statsHandler reports the server's load counters, per priority lane, the
+// upstream error rate alert, the estimated spend, the heap in use and each
+// upstream endpoint's health.
+func statsHandler(c *fiber.Ctx) error {
+	errorRate, alerting := upstreamErrors.snapshot()
+	return c.JSON(fiber.Map{
+		"upstream_in_flight":   upstreamInFlight.Load(),
+		"model_downgrades":     modelDowngrades.Load(),
+		"upstream_error_rate":  errorRate,
+		"upstream_error_alert": alerting,
+		"lanes":                laneStats(),
+		"total_cost_usd":       totalCostUSD(),
+		"heap_alloc_mb":        heapAllocBytes.Load() >> 20,
+		"memory_pressure":      memoryPressure.Load(),
+		"endpoints":            endpointStats(),
+	})
+}
@@ -1,18 +1,22 @@
 package main
 
 import (
-	"bytes"
-	"encoding/json"
+	"encoding/base64"
 	"fmt"
-	"io/ioutil"
 	"log"
 	"net/http"
-	"os"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
 
 	"github.com/gofiber/fiber/v2"
 	"github.com/gofiber/fiber/v2/middleware/cors"
 	"github.com/gofiber/fiber/v2/middleware/logger"
+	"github.com/gofiber/fiber/v2/middleware/recover"
+	"github.com/gofiber/fiber/v2/middleware/requestid"
 	"github.com/joho/godotenv"
+	"github.com/mozillazg/go-unidecode"
 )
 
 func init() {
@@ -22,147 +26,456 @@ func init() {
 }
 
 func main() {
-	app := fiber.New()
+	loadConfig()
+	if cfg.DryRun {
+		log.Printf("DRY RUN is active: the upstream API is never called and every answer is canned (latency %s)\n", cfg.DryRunLatency)
+	}
+
+	setupUpstreamClient()
+	setupEndpoints()
+	setupCORS()
+	setupLanes()
+	startMemorySampler()
+	openTraceFile()
+	startRemoteConfig()
+	connectNATS()
+	setupTracing()
+
+	app := NewApp()
+
+	go func() {
+		var err error
+		if cfg.TLSCertFile != "" {
+			log.Println("TLS is active")
+			err = app.ListenTLS(":8000", cfg.TLSCertFile, cfg.TLSKeyFile)
+		} else {
+			log.Println("TLS is not active")
+			err = app.Listen(":8000")
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+	}()
+
+	waitForShutdown(app)
+}
 
-	app.Use(cors.New(cors.Config{
-		AllowOrigins: "http://localhost:5173/",
-		AllowMethods: "GET,POST,HEAD,PUT,DELETE,PATCH",
-		AllowHeaders: "Origin, Content-Type, Accept",
+// NewApp builds the Fiber app and registers its routes. Middleware for every
+// route is registered with app.Use. API routes live in prefix groups, so
+// middleware that should only guard the API (auth, rate limiting) goes on the
+// groups and public routes registered on app directly stay open.
+func NewApp() *fiber.App {
+	app := fiber.New(fiber.Config{
+		ErrorHandler: errorHandler,
+		// Fiber's default, set explicitly because clients rely on it: /chat
+		// and /chat/ (and every other route with or without a trailing
+		// slash) reach the same handler
+		StrictRouting: false,
+	})
+
+	// Global middleware runs in this order, outermost first:
+	//  1. recover, so a panic anywhere below becomes a 500 with its stack
+	//     trace logged
+	//  2. requestid, so everything after it (logs, errors, panics) can tag
+	//     the request
+	//  3. logger, after requestid so access log lines carry the id, and
+	//     before everything that can answer early so those requests are
+	//     logged too
+	//  4. tracing, then the /chat/ preflight handler, ahead of CORS and the
+	//     chat group so a preflight never reaches either, then CORS, which
+	//     answers the other preflights itself
+	// Per-route guards (limits, body checks) go on the route groups below.
+	app.Use(recover.New(recover.Config{
+		EnableStackTrace:  true,
+		StackTraceHandler: logPanic,
+	}))
+	app.Use(requestid.New())
+	app.Use(logger.New(logger.Config{
+		Format: "${time} | ${status} | ${latency} | ${ip} | ${method} | ${path} | ${locals:requestid} | ${error}\n",
 	}))
+	app.Use(tracingMiddleware)
+	app.Options("/chat/", preflightHandler)
+	app.Use(cors.New(corsConfig))
 
-	app.Use(logger.New())
+	chat := app.Group("/chat", serverTiming, recordRecent, traceRequest, rejectUnderMemoryPressure, requestDeadline, limitConcurrentPerClient, verifySignature, requireAcceptedContentType, requireUTF8Body, requireJSONObject)
+	chat.Post("/", chatHandler)
+	chat.Post("/regenerate", regenerateHandler)
+	chat.Post("/validate", validateHandler)
+	chat.Get("/page", pageHandler)
 
-	app.Post("/chat/", chatHandler)
+	tokens := app.Group("/tokens", rejectUnderMemoryPressure, verifySignature, requireAcceptedContentType, requireUTF8Body, requireJSONObject)
+	tokens.Post("/estimate", tokenEstimateHandler)
 
-	log.Fatal(app.Listen(":8000"))
+	app.Get("/schema", schemaHandler)
+	app.Get("/stats", statsHandler)
+	app.Get("/health", healthHandler)
+	app.Get("/health/ready", readyHandler)
+	if cfg.DebugEndpoints {
+		app.Get("/debug/recent", debugRecentHandler)
+	}
+
+	return app
 }
 
 func chatHandler(c *fiber.Ctx) error {
 	log.Println("Received request for chat")
+	start := time.Now()
 
-	apiKey := os.Getenv("NVIDIA_API_KEY")
-	apiURL := "https://integrate.api.nvidia.com/v1/chat/completions"
-
-	var requestData map[string]interface{}
+	req, err := readChatRequest(c)
+	if err != nil {
+		return errorResponse(c, err)
+	}
+	noteRecent(c, req.Question, nil)
+	if req.InputTruncated {
+		c.Set("X-Input-Truncated", "true")
+	}
+	if len(req.Metadata) > 0 {
+		log.Printf("Chat request %v metadata: %s\n", c.Locals("requestid"), formatMetadata(req.Metadata))
+	}
 
-	// Parse body from request into JSON
-	if err := c.BodyParser(&requestData); err != nil {
-		log.Printf("Error parsing request body: %v\n", err)
-		return c.Status(http.StatusBadRequest).JSON(fiber.Map{
-			"error": "Invalid request body",
-		})
+	ctx := withPriority(c.UserContext(), req.Priority)
+	if req.Private {
+		ctx = withPrivate(ctx)
 	}
 
-	question, ok := requestData["question"].(string)
-	if !ok || question == "" {
-		return c.Status(http.StatusBadRequest).JSON(fiber.Map{
-			"error": "Invalid question format or empty question",
-		})
+	messages, requestPayload, err := buildChatPayload(req)
+	if err != nil {
+		return errorResponse(c, err)
 	}
 
-	requestPayload := map[string]interface{}{
-		"model": "meta/llama3-70b-instruct",
-		"messages": []map[string]string{
-			{
-				"role":    "system",
-				"content": "You are an AI that provides direct answers to coding questions.",
-			},
-			{
-				"role":    "user",
-				"content": question,
-			},
-		},
-		"temperature": 0.5,
-		"top_p":       1,
-		"max_tokens":  1024,
-	}
-
-	jsonValue, _ := json.Marshal(requestPayload)
-	log.Printf("Sending request to NVIDIA NIM API: %s\n", string(jsonValue))
-
-	// Create a new HTTP request
-	req, err := http.NewRequest("POST", apiURL, bytes.NewBuffer(jsonValue))
+	result, cheapFirst, downgraded, err := finalizeChatPayload(c, requestPayload, req)
 	if err != nil {
-		log.Printf("Error creating request: %v\n", err)
-		return c.Status(http.StatusInternalServerError).JSON(fiber.Map{
-			"error": fmt.Sprintf("Error creating request: %v", err),
-		})
+		return errorResponse(c, err)
+	}
+	canned := result != nil
+	if downgraded {
+		modelDowngrades.Add(1)
 	}
 
-	// Set headers
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Authorization", "Bearer "+apiKey)
+	fellBack := false
+	if !canned {
+		result, fellBack, err = callUpstreamWithFallback(ctx, requestPayload)
+		if err != nil {
+			return errorResponse(c, err)
+		}
+	}
+	if fellBack {
+		c.Set("X-Model-Fallback", "true")
+	}
 
-	// Send the request
-	client := &http.Client{}
-	resp, err := client.Do(req)
-	if err != nil {
-		log.Printf("Error sending request: %v\n", err)
-		return c.Status(http.StatusInternalServerError).JSON(fiber.Map{
-			"error": fmt.Sprintf("Error sending request: %v", err),
-		})
+	// Optionally ask ESCALATION_MODEL again when the cheap model's answer
+	// looks poor, keeping the cheap answer if that fails
+	if cheapFirst && result.ToolCalls == nil {
+		if reason, escalate := needsEscalation(result.Answer); escalate {
+			log.Printf("Escalating from %v to %s: %s\n", requestPayload["model"], cfg.EscalationModel, reason)
+			cheapModel := requestPayload["model"]
+			requestPayload["model"] = cfg.EscalationModel
+			if escalated, err := callUpstream(ctx, requestPayload); err != nil {
+				log.Printf("Error escalating to %s, keeping the %v answer: %v\n", cfg.EscalationModel, cheapModel, err)
+				requestPayload["model"] = cheapModel
+			} else {
+				result = escalated
+				c.Set("X-Escalated", "true")
+			}
+		}
 	}
-	defer resp.Body.Close()
 
-	// Read the response body
-	body, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		log.Printf("Error reading response body: %v\n", err)
-		return c.Status(http.StatusInternalServerError).JSON(fiber.Map{
-			"error": fmt.Sprintf("Error reading response body: %v", err),
-		})
+	// Optionally retry once when the model returns a uselessly short answer;
+	// tool calls have no answer text to judge
+	if !canned && result.ToolCalls == nil && isShortAnswer(result.Answer) {
+		log.Printf("Answer shorter than %d characters, retrying\n", cfg.MinAnswerChars)
+		result, err = callUpstream(ctx, requestPayload)
+		if err != nil {
+			return errorResponse(c, err)
+		}
+		if isShortAnswer(result.Answer) {
+			log.Printf("Answer still shorter than %d characters after retry\n", cfg.MinAnswerChars)
+			c.Set("X-Short-Answer", "true")
+		}
 	}
 
-	log.Printf("Response status: %s\n", resp.Status)
-	log.Printf("Response body: %s\n", string(body))
+	// Optionally check the answer is in the requested language, retrying once
+	// with a stronger instruction when it isn't
+	if !canned && cfg.VerifyAnswerLanguage && req.Language != "" && result.ToolCalls == nil {
+		want, known := lookupLanguage(req.Language)
+		if !known {
+			log.Printf("Unknown language %q, skipping answer language check\n", req.Language)
+		} else if got, ok := answerInLanguage(result.Answer, want); !ok {
+			log.Printf("Answer language mismatch: wanted %s, got %s, retrying\n", want, got)
+			strengthenLanguageInstruction(messages, want.String())
+			result, err = callUpstream(ctx, requestPayload)
+			if err != nil {
+				return errorResponse(c, err)
+			}
+			if got, ok := answerInLanguage(result.Answer, want); !ok {
+				log.Printf("Answer language still mismatched after retry: wanted %s, got %s\n", want, got)
+			}
+		}
+	}
 
-	// If the status is not 200 OK, return an error
-	if resp.StatusCode != http.StatusOK {
-		return c.Status(resp.StatusCode).JSON(fiber.Map{
-			"error": fmt.Sprintf("API returned non-200 status: %s\nBody: %s", resp.Status, string(body)),
-		})
+	// Optionally check the answer has the shape the client asked for,
+	// retrying once with the pattern spelled out
+	if !canned && req.ExpectedPattern != nil && result.ToolCalls == nil && !req.ExpectedPattern.MatchString(result.Answer) {
+		log.Println("Answer doesn't match expected_pattern, retrying")
+		appendInstruction(messages, fmt.Sprintf("Your answer must match this regular expression exactly, with nothing before or after it: %s", req.ExpectedPattern))
+		result, err = callUpstream(ctx, requestPayload)
+		if err != nil {
+			return errorResponse(c, err)
+		}
+		if !req.ExpectedPattern.MatchString(result.Answer) {
+			log.Println("Answer still doesn't match expected_pattern after retry")
+			return c.Status(http.StatusBadGateway).JSON(fiber.Map{
+				"error":  "The answer did not match expected_pattern",
+				"code":   "format_mismatch",
+				"answer": result.Answer,
+			})
+		}
 	}
 
-	// If we got here, we have a 200 OK response
-	// Parse the response JSON
-	var result map[string]interface{}
-	if err := json.Unmarshal(body, &result); err != nil {
-		log.Printf("Error parsing JSON response: %v\n", err)
-		return c.Status(http.StatusInternalServerError).JSON(fiber.Map{
-			"error": fmt.Sprintf("Error parsing JSON response: %v", err),
+	// Private chats leave no record beyond request metadata, so their
+	// answers go nowhere else: not to the webhook, the page store or the
+	// suggestions model
+	if result.ToolCalls == nil && !req.Private {
+		result.Answer = postProcessAnswer(ctx, postProcessRequest{
+			RequestID: fmt.Sprint(c.Locals("requestid")),
+			Question:  req.Question,
+			Answer:    result.Answer,
+			Model:     result.Model,
 		})
 	}
 
-	// Extract the answer from the response
-	choices, ok := result["choices"].([]interface{})
-	if !ok || len(choices) == 0 {
-		return c.Status(http.StatusInternalServerError).JSON(fiber.Map{
-			"error": "Unexpected response structure from API",
-		})
+	if req.TrimAnswer {
+		result.Answer = strings.TrimSpace(result.Answer)
 	}
 
-	firstChoice, ok := choices[0].(map[string]interface{})
-	if !ok {
-		return c.Status(http.StatusInternalServerError).JSON(fiber.Map{
-			"error": "Unexpected response structure from API",
-		})
+	setRateLimitHeaders(c.Set, result.RateLimit)
+	noteRecent(c, req.Question, result)
+	noteTrace(ctx, c, req.Question, requestPayload, result)
+
+	emptyAnswer := result.ToolCalls == nil && isEmptyAnswer(result.Answer)
+	if emptyAnswer && !cfg.AllowEmptyAnswer {
+		return errorResponse(c, errEmptyAnswer)
 	}
 
-	message, ok := firstChoice["message"].(map[string]interface{})
-	if !ok {
-		return c.Status(http.StatusInternalServerError).JSON(fiber.Map{
-			"error": "Unexpected response structure from API",
+	if !req.Private {
+		publishChatEvent(chatEvent{
+			RequestID: fmt.Sprint(c.Locals("requestid")),
+			Question:  req.Question,
+			Answer:    result.Answer,
+			Model:     result.Model,
+			Usage:     result.Usage,
+			LatencyMs: time.Since(start).Milliseconds(),
+			Metadata:  req.Metadata,
+			Timestamp: start,
 		})
 	}
 
-	answer, ok := message["content"].(string)
-	if !ok {
-		return c.Status(http.StatusInternalServerError).JSON(fiber.Map{
-			"error": "Unexpected response structure from API",
-		})
+	answer := result.Answer
+	response := fiber.Map{
+		"assistant_label": req.AssistantLabel,
+	}
+	if req.Paginate && !req.Private && utf8.RuneCountInString(answer) > cfg.PageSizeChars {
+		pages, nextToken, err := paginate(answer, req.Base64Answer)
+		if err != nil {
+			return errorResponse(c, err)
+		}
+		answer = pages[0]
+		response["page"] = 1
+		response["pages"] = len(pages)
+		response["next_page_token"] = nextToken
+	}
+	response["answer"] = answer
+	if cfg.SplitReasoning {
+		response["reasoning"] = result.Reasoning
+	}
+	if req.Base64Answer {
+		response["answer"] = base64.StdEncoding.EncodeToString([]byte(answer))
+		response["encoding"] = "base64"
+	}
+	if emptyAnswer {
+		response["empty_answer"] = true
+	}
+	if result.ToolCalls != nil {
+		response["tool_calls"] = result.ToolCalls
+	}
+	if promptTokens, ok := result.Usage["prompt_tokens"].(float64); ok && req.IncludePromptTokens {
+		response["prompt_tokens"] = int(promptTokens)
+	}
+	if sources := extractSources(result.Result); sources != nil {
+		response["sources"] = sources
+	}
+	if req.HTML {
+		answerHTML, err := renderAnswerHTML(result.Answer)
+		if err != nil {
+			log.Printf("Error rendering answer as HTML: %v\n", err)
+			return errorResponse(c, fmt.Errorf("Error rendering answer as HTML: %v", err))
+		}
+		response["answer_html"] = answerHTML
+	}
+	if req.Transliterate {
+		response["answer_ascii"] = unidecode.Unidecode(result.Answer)
+	}
+	if req.ExtractCode {
+		response["code_blocks"] = extractCodeBlocks(result.Answer)
+	}
+	// Canned answers never reach the upstream, suggestions included
+	if cfg.EnableSuggestions && !canned && result.ToolCalls == nil && !emptyAnswer && !req.Private {
+		response["suggestions"] = suggestFollowUps(ctx, req.Question, result.Answer)
 	}
+	if fellBack || downgraded || cfg.VerboseResponse {
+		response["model"] = result.Model
+	}
+	if cfg.VerboseResponse {
+		response["usage"] = result.Usage
+		response["finish_reason"] = result.FinishReason
+		response["latency_ms"] = time.Since(start).Milliseconds()
+		response["cached"] = false
+		response["request_id"] = c.Locals("requestid")
+		response["effective_params"] = effectiveParams(requestPayload, req)
+		if cost, ok := estimateCost(result.Model, result.Usage); ok {
+			response["cost_usd"] = cost
+		}
+	}
+	return c.JSON(response)
+}
 
-	return c.JSON(fiber.Map{
-		"answer": answer,
-	})
+// readChatRequest decodes and validates a /chat/ body, sent either as JSON or
+// as a multipart form.
+func readChatRequest(c *fiber.Ctx) (*chatRequest, error) {
+	var requestData map[string]interface{}
+
+	if isMultipartForm(c) {
+		var err error
+		if requestData, err = parseMultipartChat(c); err != nil {
+			return nil, err
+		}
+	} else if err := parseJSONBody(c, &requestData); err != nil {
+		// Parse body from request into JSON
+		log.Printf("Error parsing request body: %v\n", err)
+		return nil, badRequest("Invalid request body")
+	}
+
+	warnings := applyFieldAliases(requestData)
+	req, err := parseChatRequest(requestData, c.Get("X-Profile"))
+	if err != nil {
+		return nil, err
+	}
+	req.Warnings = append(warnings, req.Warnings...)
+	return req, nil
+}
+
+// buildChatPayload renders the messages for req and the upstream payload that
+// carries them, with the request's profile and parameter overrides applied
+// and its raw_payload merged over the result.
+func buildChatPayload(req *chatRequest) ([]map[string]string, map[string]interface{}, error) {
+	messages, err := buildMessages(req)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	requestPayload := newPayload(messages)
+	applyProfile(requestPayload, req.Profile)
+	if cfg.AutoTemperature {
+		applyAutoTemperature(requestPayload, req)
+	}
+	if req.Model != "" {
+		requestPayload["model"] = req.Model
+	}
+	if req.LogitBias != nil {
+		requestPayload["logit_bias"] = req.LogitBias
+	}
+	if cfg.ForwardUser && req.User != "" {
+		requestPayload["user"] = req.User
+	}
+	if req.Tools != nil {
+		requestPayload["tools"] = req.Tools
+	}
+	if req.ToolChoice != nil {
+		requestPayload["tool_choice"] = req.ToolChoice
+	}
+	if len(req.RawPayload) > 0 {
+		keys := make([]string, 0, len(req.RawPayload))
+		for key, value := range req.RawPayload {
+			requestPayload[key] = value
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		log.Printf("raw_payload overrides upstream payload fields: %s\n", strings.Join(keys, ", "))
+	}
+	return messages, requestPayload, nil
+}
+
+// finalizeChatPayload makes the choices for req that depend on the server
+// rather than the body: a canned answer, or the CANNED_ONLY error when there
+// is none, else escalation's cheap starting model and a DOWNGRADE_MODELS swap
+// under load. It sets the X-Canned and X-Model-Downgraded headers to match,
+// and reports whether the answer may be escalated.
+func finalizeChatPayload(c *fiber.Ctx, payload map[string]interface{}, req *chatRequest) (canned *completion, cheapFirst, downgraded bool, err error) {
+	// Questions in CANNED_ANSWERS_PATH never reach the upstream
+	canned, err = cannedAnswer(req.Question)
+	if err != nil {
+		return nil, false, false, err
+	}
+	if canned != nil {
+		c.Set("X-Canned", "true")
+		return canned, false, false, nil
+	}
+
+	cheapFirst = startCheap(payload, req)
+	downgraded = downgradeForLoad(payload)
+	if downgraded {
+		c.Set("X-Model-Downgraded", "true")
+	}
+	return nil, cheapFirst, downgraded, nil
+}
+
+// effectiveParams reports the parameters the last upstream call was actually
+// made with, after profiles, fallbacks and downgrades, along with the profile
+// and persona that shaped it.
+func effectiveParams(payload map[string]interface{}, req *chatRequest) fiber.Map {
+	params := fiber.Map{
+		"model":       payload["model"],
+		"temperature": payload["temperature"],
+		"top_p":       payload["top_p"],
+		"max_tokens":  payload["max_tokens"],
+	}
+	if req.ProfileName != "" {
+		params["profile"] = req.ProfileName
+	}
+	if req.Persona != "" {
+		params["persona"] = req.Persona
+	}
+	return params
+}
+
+// formatMetadata renders request metadata as sorted key=value pairs for log
+// lines.
+func formatMetadata(metadata map[string]string) string {
+	pairs := make([]string, 0, len(metadata))
+	for key, value := range metadata {
+		pairs = append(pairs, fmt.Sprintf("%s=%q", key, value))
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, " ")
+}
+
+// isShortAnswer reports whether answer falls below MIN_ANSWER_CHARS.
+func isShortAnswer(answer string) bool {
+	return utf8.RuneCountInString(strings.TrimSpace(answer)) < cfg.MinAnswerChars
+}
+
+// strengthenLanguageInstruction adds an explicit instruction to answer in
+// language.
+func strengthenLanguageInstruction(messages []map[string]string, language string) {
+	appendInstruction(messages, fmt.Sprintf("You must write your entire answer in %s.", language))
+}
+
+// appendInstruction adds instruction to the system message when there is one
+// and otherwise to the final user message.
+func appendInstruction(messages []map[string]string, instruction string) {
+	target := messages[len(messages)-1]
+	if messages[0]["role"] == "system" {
+		target = messages[0]
+	}
+	target["content"] = fmt.Sprintf("%s\n\n%s", target["content"], instruction)
 }
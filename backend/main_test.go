@@ -0,0 +1,17 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+// TestChatTrailingSlash checks /chat and /chat/ reach the same handler.
+func TestChatTrailingSlash(t *testing.T) {
+	app := newTestApp(t, answerWith("hello"), nil)
+	for _, path := range []string{"/chat", "/chat/"} {
+		status, body := postChat(t, app, path, `{"question": "hello"}`)
+		if status != http.StatusOK || body["answer"] != "hello" {
+			t.Errorf("POST %s: got %d %v, want 200 with the answer", path, status, body)
+		}
+	}
+}
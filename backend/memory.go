@@ -0,0 +1,66 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"runtime"
+	"sync/atomic"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// memorySampleInterval is how often the heap is measured. ReadMemStats
+// stops the world briefly, so it isn't done per request.
+const memorySampleInterval = time.Second
+
+var (
+	// heapAllocBytes is the heap in use at the last sample.
+	heapAllocBytes atomic.Uint64
+
+	// memoryPressure is set while the heap is over MEM_PRESSURE_THRESHOLD_MB.
+	memoryPressure atomic.Bool
+)
+
+// startMemorySampler measures the heap now and every memorySampleInterval,
+// for /stats and rejectUnderMemoryPressure.
+func startMemorySampler() {
+	sampleMemory()
+	go func() {
+		for range time.Tick(memorySampleInterval) {
+			sampleMemory()
+		}
+	}()
+}
+
+func sampleMemory() {
+	var stats runtime.MemStats
+	runtime.ReadMemStats(&stats)
+	heapAllocBytes.Store(stats.HeapAlloc)
+
+	if cfg.MemPressureThresholdMB == 0 {
+		return
+	}
+	over := stats.HeapAlloc > uint64(cfg.MemPressureThresholdMB)<<20
+	if memoryPressure.Swap(over) != over {
+		if over {
+			log.Printf("Heap at %d MB is over MEM_PRESSURE_THRESHOLD_MB (%d MB), rejecting new requests\n", stats.HeapAlloc>>20, cfg.MemPressureThresholdMB)
+		} else {
+			log.Printf("Heap back down to %d MB, accepting requests again\n", stats.HeapAlloc>>20)
+		}
+	}
+}
+
+// rejectUnderMemoryPressure turns requests away with 503 server_overloaded
+// while the heap is over MEM_PRESSURE_THRESHOLD_MB, as a last resort before
+// running out of memory.
+func rejectUnderMemoryPressure(c *fiber.Ctx) error {
+	if memoryPressure.Load() {
+		return errorResponse(c, &apiError{
+			Status:  http.StatusServiceUnavailable,
+			Message: "Server is overloaded, try again shortly",
+			Code:    "server_overloaded",
+		})
+	}
+	return c.Next()
+}
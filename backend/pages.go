@@ -0,0 +1,106 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// pagedAnswer is an answer split into pages, kept until it expires so
+// clients can fetch the pages after the first one.
+type pagedAnswer struct {
+	pages   []string
+	base64  bool
+	expires time.Time
+}
+
+// pagedAnswers holds paginated answers by id. Expired ones are dropped
+// whenever an answer is stored.
+var pagedAnswers = newStore[string, *pagedAnswer]()
+
+// paginate splits answer into PAGE_SIZE_CHARS pages and stores them. It
+// returns the pages and the token for the second one.
+func paginate(answer string, base64Pages bool) (pages []string, nextToken string, err error) {
+	pages = splitPages(answer, cfg.PageSizeChars)
+
+	idBytes := make([]byte, 16)
+	if _, err := rand.Read(idBytes); err != nil {
+		return nil, "", fmt.Errorf("Error generating page token: %v", err)
+	}
+	id := hex.EncodeToString(idBytes)
+
+	now := time.Now()
+	pagedAnswers.deleteIf(func(_ string, paged *pagedAnswer) bool {
+		return now.After(paged.expires)
+	})
+	pagedAnswers.set(id, &pagedAnswer{pages: pages, base64: base64Pages, expires: now.Add(cfg.PageTTL)})
+
+	return pages, pageToken(id, 1), nil
+}
+
+// splitPages cuts text into pages of at most size characters, breaking at
+// the last whitespace in a page's second half when there is one so words
+// stay whole.
+func splitPages(text string, size int) []string {
+	runes := []rune(text)
+	var pages []string
+	for len(runes) > size {
+		cut := size
+		for i := size; i > size/2; i-- {
+			if unicode.IsSpace(runes[i-1]) {
+				cut = i
+				break
+			}
+		}
+		pages = append(pages, string(runes[:cut]))
+		runes = runes[cut:]
+	}
+	return append(pages, string(runes))
+}
+
+// pageToken names page index (0-based) of answer id.
+func pageToken(id string, index int) string {
+	return fmt.Sprintf("%s.%d", id, index)
+}
+
+// pageHandler serves GET /chat/page?token=..., returning the page the token
+// names and the token for the one after it, if any.
+func pageHandler(c *fiber.Ctx) error {
+	id, rawIndex, _ := strings.Cut(c.Query("token"), ".")
+	index, err := strconv.Atoi(rawIndex)
+	if err != nil {
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid page token",
+		})
+	}
+
+	paged, ok := pagedAnswers.get(id)
+	if !ok || time.Now().After(paged.expires) || index < 0 || index >= len(paged.pages) {
+		return c.Status(http.StatusNotFound).JSON(fiber.Map{
+			"error": "Page not found or expired",
+			"code":  "page_expired",
+		})
+	}
+
+	response := fiber.Map{
+		"answer": paged.pages[index],
+		"page":   index + 1,
+		"pages":  len(paged.pages),
+	}
+	if paged.base64 {
+		response["answer"] = base64.StdEncoding.EncodeToString([]byte(paged.pages[index]))
+		response["encoding"] = "base64"
+	}
+	if index+1 < len(paged.pages) {
+		response["next_page_token"] = pageToken(id, index+1)
+	}
+	return c.JSON(response)
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestSplitPages(t *testing.T) {
+	tests := []struct {
+		name string
+		text string
+		size int
+		want []string
+	}{
+		{"fits", "short", 10, []string{"short"}},
+		{"breaks after whitespace", "aaaa bbbb cccc", 7, []string{"aaaa ", "bbbb ", "cccc"}},
+		{"whitespace right after a full page", "aaaaa bbbbb", 5, []string{"aaaaa", " bbbb", "b"}},
+		{"no whitespace in the second half", "abcdefghij", 4, []string{"abcd", "efgh", "ij"}},
+		{"multibyte runes", "ééé ééé ééé", 4, []string{"ééé ", "ééé ", "ééé"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pages := splitPages(tt.text, tt.size)
+			if strings.Join(pages, "") != tt.text {
+				t.Errorf("pages %q don't join back to %q", pages, tt.text)
+			}
+			for _, page := range pages {
+				if n := utf8.RuneCountInString(page); n > tt.size {
+					t.Errorf("page %q is %d characters, over the %d limit", page, n, tt.size)
+				}
+			}
+			if strings.Join(pages, "|") != strings.Join(tt.want, "|") {
+				t.Errorf("pages = %q, want %q", pages, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"runtime/debug"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// logPanic logs a recovered handler panic with its stack trace, tagged with
+// the request id so it can be matched to the client's error response.
+func logPanic(c *fiber.Ctx, e interface{}) {
+	log.Printf("PANIC in %s %s (request %v): %v\n%s\n", c.Method(), c.Path(), c.Locals("requestid"), e, debug.Stack())
+}
+
+// errorHandler answers errors that reach Fiber, such as unknown routes and
+// recovered panics, with the same JSON shape as handler errors. Anything
+// other than a fiber.Error is reported as a bare 500 so panic values aren't
+// leaked to clients.
+func errorHandler(c *fiber.Ctx, err error) error {
+	status, message := http.StatusInternalServerError, "Internal Server Error"
+	var fiberErr *fiber.Error
+	if errors.As(err, &fiberErr) {
+		status, message = fiberErr.Code, fiberErr.Message
+	}
+
+	return c.Status(status).JSON(fiber.Map{
+		"error":      message,
+		"request_id": c.Locals("requestid"),
+	})
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"bytes"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+func TestPanicRecovery(t *testing.T) {
+	app := newTestApp(t, answerWith("hello"), nil)
+	app.Get("/test/panic", func(c *fiber.Ctx) error {
+		panic("boom")
+	})
+
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+
+	req := httptest.NewRequest(http.MethodGet, "/test/panic", nil)
+	req.Header.Set(fiber.HeaderXRequestID, "panic-request-1")
+	status, body := doRequest(t, app, req)
+
+	if status != http.StatusInternalServerError {
+		t.Errorf("status = %d, want 500", status)
+	}
+	if body["error"] != "Internal Server Error" || body["request_id"] != "panic-request-1" {
+		t.Errorf("body = %v, want the bare 500 with the request id", body)
+	}
+	logged := logs.String()
+	if !strings.Contains(logged, "PANIC in GET /test/panic (request panic-request-1): boom") {
+		t.Errorf("panic not logged with its request id:\n%s", logged)
+	}
+	if !strings.Contains(logged, "panics_test.go") {
+		t.Errorf("stack trace not logged:\n%s", logged)
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// modelPrice is what a model costs in USD per million prompt and completion
+// tokens.
+type modelPrice struct {
+	Prompt     float64
+	Completion float64
+}
+
+// loadModelPricing parses MODEL_PRICING, a "model:prompt:completion" list
+// of USD prices per million tokens. Model names may contain ":" themselves,
+// so each entry splits on the last two. Anything else is fatal.
+func loadModelPricing() map[string]modelPrice {
+	pricing := map[string]modelPrice{}
+	for _, entry := range strings.Split(os.Getenv("MODEL_PRICING"), ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		parts := strings.Split(entry, ":")
+		if len(parts) < 3 {
+			log.Fatalf("Invalid MODEL_PRICING entry %q: expected model:prompt:completion\n", entry)
+		}
+		n := len(parts)
+		prompt, promptErr := strconv.ParseFloat(strings.TrimSpace(parts[n-2]), 64)
+		completion, completionErr := strconv.ParseFloat(strings.TrimSpace(parts[n-1]), 64)
+		model := strings.TrimSpace(strings.Join(parts[:n-2], ":"))
+		if model == "" || promptErr != nil || completionErr != nil || prompt < 0 || completion < 0 {
+			log.Fatalf("Invalid MODEL_PRICING entry %q: expected model:prompt:completion with non-negative USD prices per million tokens\n", entry)
+		}
+		pricing[model] = modelPrice{Prompt: prompt, Completion: completion}
+	}
+	return pricing
+}
+
+// estimateCost returns what usage cost on model by MODEL_PRICING, and false
+// when the model has no price or the usage no token counts.
+func estimateCost(model string, usage map[string]interface{}) (float64, bool) {
+	price, ok := cfg.ModelPricing[model]
+	if !ok {
+		return 0, false
+	}
+	promptTokens, promptOK := usage["prompt_tokens"].(float64)
+	completionTokens, completionOK := usage["completion_tokens"].(float64)
+	if !promptOK && !completionOK {
+		return 0, false
+	}
+	return (promptTokens*price.Prompt + completionTokens*price.Completion) / 1e6, true
+}
+
+// totalCost is the estimated cost of every upstream call since startup,
+// retries included, for /stats.
+var totalCost struct {
+	sync.Mutex
+	usd float64
+}
+
+// addCost adds the estimated cost of an upstream completion to totalCost.
+func addCost(model string, usage map[string]interface{}) {
+	cost, ok := estimateCost(model, usage)
+	if !ok {
+		return
+	}
+	totalCost.Lock()
+	totalCost.usd += cost
+	totalCost.Unlock()
+}
+
+// totalCostUSD returns totalCost.
+func totalCostUSD() float64 {
+	totalCost.Lock()
+	defer totalCost.Unlock()
+	return totalCost.usd
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+)
+
+// profile is a named bundle of defaults for one "assistant" served by this
+// server, selected per request with "profile" or the X-Profile header. Unset
+// fields keep the server-wide defaults.
+type profile struct {
+	Model           string   `json:"model"`
+	SystemPrompt    string   `json:"system_prompt"`
+	Temperature     *float64 `json:"temperature"`
+	TopP            *float64 `json:"top_p"`
+	MaxTokens       *int     `json:"max_tokens"`
+	MaxContextChars *int     `json:"max_context_chars"`
+}
+
+// defaultProfileName is used when a request names no profile, if
+// PROFILES_FILE defines it.
+const defaultProfileName = "default"
+
+// loadProfiles reads the JSON object of profile name to profile in
+// PROFILES_FILE, if set. An unreadable file or an out-of-range value is
+// fatal.
+func loadProfiles() map[string]profile {
+	path := os.Getenv("PROFILES_FILE")
+	if path == "" {
+		return map[string]profile{}
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		log.Fatalf("Error reading PROFILES_FILE: %v\n", err)
+	}
+	var profiles map[string]profile
+	if err := json.Unmarshal(data, &profiles); err != nil {
+		log.Fatalf("Error parsing PROFILES_FILE: %v\n", err)
+	}
+	for name, p := range profiles {
+		switch {
+		case p.Temperature != nil && (*p.Temperature < 0 || *p.Temperature > 2):
+			log.Fatalf("Invalid PROFILES_FILE profile %q: temperature must be between 0 and 2\n", name)
+		case p.TopP != nil && (*p.TopP <= 0 || *p.TopP > 1):
+			log.Fatalf("Invalid PROFILES_FILE profile %q: top_p must be above 0 and at most 1\n", name)
+		case p.MaxTokens != nil && *p.MaxTokens <= 0:
+			log.Fatalf("Invalid PROFILES_FILE profile %q: max_tokens must be positive\n", name)
+		case p.MaxContextChars != nil && *p.MaxContextChars < 0:
+			log.Fatalf("Invalid PROFILES_FILE profile %q: max_context_chars must not be negative\n", name)
+		}
+	}
+	return profiles
+}
+
+// selectProfile returns the profile a request asked for by name, falling back
+// to the "default" profile when name is empty. It returns nil when there is
+// no such default, and an error for an unknown name.
+func selectProfile(name string) (*profile, error) {
+	if name == "" {
+		if p, ok := cfg.Profiles[defaultProfileName]; ok {
+			return &p, nil
+		}
+		return nil, nil
+	}
+
+	p, ok := cfg.Profiles[name]
+	if !ok {
+		return nil, badRequest("Unknown profile %q", name)
+	}
+	return &p, nil
+}
+
+// applyProfile overrides payload's model and sampling parameters with those
+// set in p.
+func applyProfile(payload map[string]interface{}, p *profile) {
+	if p == nil {
+		return
+	}
+	if p.Model != "" {
+		payload["model"] = p.Model
+	}
+	if p.Temperature != nil {
+		payload["temperature"] = *p.Temperature
+	}
+	if p.TopP != nil {
+		payload["top_p"] = *p.TopP
+	}
+	if p.MaxTokens != nil {
+		payload["max_tokens"] = *p.MaxTokens
+	}
+}
+
+// maxContextChars returns the context size limit under p.
+func (p *profile) maxContextChars() int {
+	if p != nil && p.MaxContextChars != nil {
+		return *p.MaxContextChars
+	}
+	return cfg.MaxContextChars
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"text/template"
+	"unicode/utf8"
+)
+
+const defaultSystemPrompt = "You are an AI that provides direct answers to coding questions."
+
+// defaultPersonas are the presets available to requests' "persona" field.
+// PERSONAS_FILE can override them or add more.
+var defaultPersonas = map[string]string{
+	"tutor":    "You are a patient programming tutor. Explain the concepts behind your answer step by step so the user learns how to solve similar problems themselves.",
+	"reviewer": "You are a senior code reviewer. Point out bugs, risky patterns and style problems in the code you are shown, and suggest concrete fixes.",
+	"debugger": "You are an expert debugger. Work out the most likely cause of the problem described, explain how to confirm it, and give a fix.",
+}
+
+// defaultVerbosityInstructions are added to the system prompt for a request's
+// "verbosity". "normal" adds nothing. VERBOSITY_CONCISE and VERBOSITY_DETAILED
+// replace them.
+var defaultVerbosityInstructions = map[string]string{
+	"concise":  "Keep your answer short: give only what is needed to answer the question, with no preamble or extra explanation.",
+	"detailed": "Give a thorough answer: explain your reasoning, cover edge cases and alternatives, and include examples where they help.",
+}
+
+// loadVerbosityInstructions returns the instruction for each verbosity
+// level, with the defaults replaced by VERBOSITY_CONCISE and
+// VERBOSITY_DETAILED when set.
+func loadVerbosityInstructions() map[string]string {
+	return map[string]string{
+		"concise":  envString("VERBOSITY_CONCISE", defaultVerbosityInstructions["concise"]),
+		"normal":   "",
+		"detailed": envString("VERBOSITY_DETAILED", defaultVerbosityInstructions["detailed"]),
+	}
+}
+
+// loadPersonas returns the default personas merged with the JSON object of
+// name to system prompt in PERSONAS_FILE, if set. A bad file is fatal.
+func loadPersonas() map[string]string {
+	personas := map[string]string{}
+	for name, prompt := range defaultPersonas {
+		personas[name] = prompt
+	}
+
+	path := os.Getenv("PERSONAS_FILE")
+	if path == "" {
+		return personas
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		log.Fatalf("Error reading PERSONAS_FILE: %v\n", err)
+	}
+	var fromFile map[string]string
+	if err := json.Unmarshal(data, &fromFile); err != nil {
+		log.Fatalf("Error parsing PERSONAS_FILE, expected an object of name to prompt: %v\n", err)
+	}
+	for name, prompt := range fromFile {
+		personas[name] = prompt
+	}
+	return personas
+}
+
+// promptData is what prompt templates are rendered with. It only holds plain
+// strings, so values supplied in a request are always rendered as text and a
+// template has no functions to call beyond the text/template builtins.
+type promptData struct {
+	Language string
+	Question string
+	Vars     map[string]string
+}
+
+// loadPromptTemplate parses the template held in the env var name, or in the
+// file named by name+"_FILE", which takes precedence. It returns nil when
+// neither is set and exits on an unreadable file or a bad template.
+func loadPromptTemplate(name string) *template.Template {
+	text := readEnvOrFile(name)
+	if text == "" {
+		return nil
+	}
+
+	tmpl, err := template.New(name).Option("missingkey=zero").Parse(text)
+	if err != nil {
+		log.Fatalf("Error parsing %s: %v\n", name, err)
+	}
+	return tmpl
+}
+
+// renderPrompt renders tmpl with data, or returns fallback when no template
+// is configured.
+func renderPrompt(tmpl *template.Template, fallback string, data promptData) (string, error) {
+	if tmpl == nil {
+		return fallback, nil
+	}
+
+	var b strings.Builder
+	if err := tmpl.Execute(&b, data); err != nil {
+		return "", err
+	}
+	return b.String(), nil
+}
+
+// parseVars converts the request's "vars" object into template variables.
+// Only string values are accepted.
+func parseVars(raw interface{}) (map[string]string, bool) {
+	vars := map[string]string{}
+	if raw == nil {
+		return vars, true
+	}
+
+	obj, ok := raw.(map[string]interface{})
+	if !ok {
+		return nil, false
+	}
+	for key, value := range obj {
+		s, ok := value.(string)
+		if !ok {
+			return nil, false
+		}
+		vars[key] = s
+	}
+	return vars, true
+}
+
+// parseContext converts the request's "context" array into the snippets sent
+// ahead of the question. Blank entries are dropped; ok is false when the value
+// is not an array of strings.
+func parseContext(raw interface{}) (snippets []string, size int, ok bool) {
+	if raw == nil {
+		return nil, 0, true
+	}
+
+	items, ok := raw.([]interface{})
+	if !ok {
+		return nil, 0, false
+	}
+	for _, item := range items {
+		s, ok := item.(string)
+		if !ok {
+			return nil, 0, false
+		}
+		if strings.TrimSpace(s) == "" {
+			continue
+		}
+		snippets = append(snippets, s)
+		size += utf8.RuneCountInString(s)
+	}
+	return snippets, size, true
+}
+
+// buildMessages renders the upstream messages for req. The system prompt is
+// the request's own system_prompt if given, else its persona's prompt, else
+// its profile's, else the configured template or default, wrapped in any
+// system_prefix and system_suffix, then followed by the verbosity
+// instruction; context snippets go ahead of the question as their own user
+// messages.
+func buildMessages(req *chatRequest) ([]map[string]string, error) {
+	data := promptData{Language: req.Language, Question: req.Question, Vars: req.Vars}
+
+	var systemPrompt string
+	switch {
+	case req.SystemPrompt != "":
+		systemPrompt = req.SystemPrompt
+	case req.Persona != "":
+		systemPrompt = cfg.Personas[req.Persona]
+	case req.Profile != nil && req.Profile.SystemPrompt != "":
+		systemPrompt = req.Profile.SystemPrompt
+	default:
+		var err error
+		systemPrompt, err = renderPrompt(cfg.SystemTemplate, currentSystemPrompt(), data)
+		if err != nil {
+			log.Printf("Error rendering system prompt template: %v\n", err)
+			return nil, fmt.Errorf("Error rendering system prompt template: %v", err)
+		}
+	}
+
+	if req.SystemPrefix != "" {
+		systemPrompt = req.SystemPrefix + "\n\n" + systemPrompt
+	}
+	if req.SystemSuffix != "" {
+		systemPrompt = systemPrompt + "\n\n" + req.SystemSuffix
+	}
+
+	userPrompt, err := renderPrompt(cfg.UserTemplate, req.Question, data)
+	if err != nil {
+		log.Printf("Error rendering user prompt template: %v\n", err)
+		return nil, fmt.Errorf("Error rendering user prompt template: %v", err)
+	}
+
+	messages := []map[string]string{}
+	if !req.NoSystemPrompt {
+		messages = append(messages, map[string]string{
+			"role":    "system",
+			"content": systemPrompt,
+		})
+	}
+	for _, snippet := range req.Context {
+		messages = append(messages, map[string]string{
+			"role":    "user",
+			"content": snippet,
+		})
+	}
+	messages = append(messages, map[string]string{
+		"role":    "user",
+		"content": userPrompt,
+	})
+	if instruction := cfg.VerbosityInstructions[req.Verbosity]; instruction != "" {
+		appendInstruction(messages, instruction)
+	}
+	return messages, nil
+}
@@ -0,0 +1,49 @@
+package main
+
+import "testing"
+
+func TestBuildMessagesSystemPrompt(t *testing.T) {
+	cfg = config{Personas: map[string]string{"pirate": "Talk like a pirate."}}
+
+	tests := []struct {
+		name           string
+		noSystemPrompt bool
+		persona        string
+		systemPrompt   string
+		want           string // the system message, "" for none
+	}{
+		{"defaults", false, "", "", defaultSystemPrompt},
+		{"persona", false, "pirate", "", "Talk like a pirate."},
+		{"system_prompt", false, "", "Be brief.", "Be brief."},
+		{"system_prompt over persona", false, "pirate", "Be brief.", "Be brief."},
+		{"no_system_prompt", true, "", "", ""},
+		{"no_system_prompt drops persona", true, "pirate", "", ""},
+		{"no_system_prompt drops system_prompt", true, "", "Be brief.", ""},
+		{"no_system_prompt drops both", true, "pirate", "Be brief.", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			messages, err := buildMessages(&chatRequest{
+				Question:       "hello",
+				NoSystemPrompt: tt.noSystemPrompt,
+				Persona:        tt.persona,
+				SystemPrompt:   tt.systemPrompt,
+			})
+			if err != nil {
+				t.Fatalf("buildMessages: %v", err)
+			}
+
+			last := messages[len(messages)-1]
+			if last["role"] != "user" || last["content"] != "hello" {
+				t.Errorf("last message = %v, want the question", last)
+			}
+			var got string
+			if messages[0]["role"] == "system" {
+				got = messages[0]["content"]
+			}
+			if got != tt.want {
+				t.Errorf("system message = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"text/template"
+)
+
+// defaultRequestTemplate sends the payload as is, which is the OpenAI chat
+// completions shape the NVIDIA NIM API expects.
+const defaultRequestTemplate = `{{json .}}`
+
+// defaultAnswerPath is where OpenAI-shaped responses hold the answer.
+const defaultAnswerPath = "choices.0.message.content"
+
+// loadRequestTemplate parses UPSTREAM_REQUEST_TEMPLATE (or the file named by
+// UPSTREAM_REQUEST_TEMPLATE_FILE), which renders the upstream request body
+// from the payload for providers that don't use the OpenAI schema. Templates
+// get a json function to encode values, e.g.
+//
+//	{"prompt": {{json (index .messages 0).content}}, "model": {{json .model}}}
+//
+// A bad template is fatal.
+func loadRequestTemplate() *template.Template {
+	text := readEnvOrFile("UPSTREAM_REQUEST_TEMPLATE")
+	if text == "" {
+		text = defaultRequestTemplate
+	}
+
+	tmpl, err := template.New("UPSTREAM_REQUEST_TEMPLATE").
+		Option("missingkey=zero").
+		Funcs(template.FuncMap{"json": templateJSON}).
+		Parse(text)
+	if err != nil {
+		log.Fatalf("Error parsing UPSTREAM_REQUEST_TEMPLATE: %v\n", err)
+	}
+	return tmpl
+}
+
+// templateJSON encodes v for embedding in a request template.
+func templateJSON(v interface{}) (string, error) {
+	b, err := json.Marshal(v)
+	return string(b), err
+}
+
+// renderRequestBody renders the upstream request body for payload, checking
+// that the template produced valid JSON.
+func renderRequestBody(payload map[string]interface{}) ([]byte, error) {
+	var b bytes.Buffer
+	if err := cfg.RequestTemplate.Execute(&b, payload); err != nil {
+		return nil, err
+	}
+	if !json.Valid(b.Bytes()) {
+		return nil, fmt.Errorf("UPSTREAM_REQUEST_TEMPLATE did not render valid JSON")
+	}
+	return b.Bytes(), nil
+}
+
+// lookupPath follows a dotted path of object keys and array indexes, such as
+// "choices.0.message.content", through a decoded JSON value.
+func lookupPath(value interface{}, path string) (interface{}, bool) {
+	for _, part := range strings.Split(path, ".") {
+		switch v := value.(type) {
+		case map[string]interface{}:
+			next, ok := v[part]
+			if !ok {
+				return nil, false
+			}
+			value = next
+		case []interface{}:
+			i, err := strconv.Atoi(part)
+			if err != nil || i < 0 || i >= len(v) {
+				return nil, false
+			}
+			value = v[i]
+		default:
+			return nil, false
+		}
+	}
+	return value, true
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// upstreamRateLimit is what the upstream's x-ratelimit-* headers said about
+// the remaining quota.
+type upstreamRateLimit struct {
+	Remaining string
+	Reset     string
+}
+
+// lastRateLimitRemaining is the most recent x-ratelimit-remaining seen, or -1
+// before any upstream response carried it.
+var lastRateLimitRemaining atomic.Int64
+
+func init() {
+	lastRateLimitRemaining.Store(-1)
+}
+
+// readRateLimit logs and records the upstream's rate-limit headers.
+func readRateLimit(header http.Header) upstreamRateLimit {
+	limit := upstreamRateLimit{
+		Remaining: header.Get("x-ratelimit-remaining"),
+		Reset:     header.Get("x-ratelimit-reset"),
+	}
+	if limit.Remaining == "" && limit.Reset == "" {
+		return limit
+	}
+
+	log.Printf("Upstream rate limit: remaining=%s reset=%s\n", limit.Remaining, limit.Reset)
+	if remaining, err := strconv.ParseInt(limit.Remaining, 10, 64); err == nil {
+		lastRateLimitRemaining.Store(remaining)
+	}
+	return limit
+}
+
+// slowForRateLimit delays an upstream call by RATELIMIT_SLOWDOWN_MS while the
+// last reported remaining quota is below RATELIMIT_SLOWDOWN_THRESHOLD, to
+// spread requests out before the upstream starts rejecting them.
+func slowForRateLimit(ctx context.Context) {
+	if cfg.RateLimitSlowdown == 0 {
+		return
+	}
+	remaining := lastRateLimitRemaining.Load()
+	if remaining < 0 || remaining >= int64(cfg.RateLimitSlowdownThreshold) {
+		return
+	}
+
+	log.Printf("Upstream rate limit remaining is %d, delaying call by %s\n", remaining, cfg.RateLimitSlowdown)
+	select {
+	case <-time.After(cfg.RateLimitSlowdown):
+	case <-ctx.Done():
+	}
+}
+
+// setRateLimitHeaders passes the upstream's rate-limit headers on to the
+// client.
+func setRateLimitHeaders(set func(key, value string), limit upstreamRateLimit) {
+	if limit.Remaining != "" {
+		set("X-Upstream-RateLimit-Remaining", limit.Remaining)
+	}
+	if limit.Reset != "" {
+		set("X-Upstream-RateLimit-Reset", limit.Reset)
+	}
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"log"
+	"regexp"
+	"strings"
+)
+
+// defaultReasoningPattern matches the <think> sections reasoning models wrap
+// their chain of thought in.
+const defaultReasoningPattern = `(?s)<think>(.*?)</think>`
+
+// loadReasoningPattern compiles REASONING_PATTERN, whose first group is the
+// reasoning inside each match. A bad pattern is fatal.
+func loadReasoningPattern() *regexp.Regexp {
+	pattern := envString("REASONING_PATTERN", defaultReasoningPattern)
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		log.Fatalf("Invalid REASONING_PATTERN %q: %v\n", pattern, err)
+	}
+	if re.NumSubexp() < 1 {
+		log.Fatalf("Invalid REASONING_PATTERN %q: needs a group capturing the reasoning\n", pattern)
+	}
+	return re
+}
+
+// splitReasoning separates the reasoning sections REASONING_PATTERN finds in
+// answer from the final answer. An answer without any has empty reasoning.
+func splitReasoning(answer string) (reasoning, final string) {
+	sections := []string{}
+	for _, match := range cfg.ReasoningPattern.FindAllStringSubmatch(answer, -1) {
+		if section := strings.TrimSpace(match[1]); section != "" {
+			sections = append(sections, section)
+		}
+	}
+	if len(sections) == 0 {
+		return "", answer
+	}
+	return strings.Join(sections, "\n\n"), strings.TrimSpace(cfg.ReasoningPattern.ReplaceAllString(answer, ""))
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"unicode/utf8"
+)
+
+// redact replaces text with a short hash and its length, so log lines can
+// still be correlated without exposing the content.
+func redact(text string) string {
+	sum := sha256.Sum256([]byte(text))
+	return fmt.Sprintf("[redacted sha256:%s len:%d]", hex.EncodeToString(sum[:6]), utf8.RuneCountInString(text))
+}
+
+// privateKey marks the context of a request sent with "private": true.
+type privateKey struct{}
+
+// withPrivate returns ctx marked as belonging to a private request, whose
+// content is redacted from logs regardless of REDACT_PROMPTS.
+func withPrivate(ctx context.Context) context.Context {
+	return context.WithValue(ctx, privateKey{}, true)
+}
+
+// shouldRedact reports whether content logged for the request behind ctx
+// must be redacted.
+func shouldRedact(ctx context.Context) bool {
+	return cfg.RedactPrompts || ctx.Value(privateKey{}) != nil
+}
+
+// payloadForLog renders an upstream payload as JSON for logging. With
+// REDACT_PROMPTS on or for a private request, the message contents are
+// redacted and everything else (model, sampling parameters) is kept.
+func payloadForLog(ctx context.Context, payload map[string]interface{}) string {
+	if shouldRedact(ctx) {
+		redacted := make(map[string]interface{}, len(payload))
+		for key, value := range payload {
+			redacted[key] = value
+		}
+
+		if messages, ok := payload["messages"].([]map[string]string); ok {
+			redactedMessages := make([]map[string]string, len(messages))
+			for i, message := range messages {
+				redactedMessages[i] = map[string]string{
+					"role":    message["role"],
+					"content": redact(message["content"]),
+				}
+			}
+			redacted["messages"] = redactedMessages
+		}
+		payload = redacted
+	}
+
+	jsonValue, _ := json.Marshal(payload)
+	return string(jsonValue)
+}
+
+// bodyForLog returns an upstream response body for logging, redacted with
+// REDACT_PROMPTS on or for a private request, and without its reasoning
+// sections under OMIT_REASONING_FROM_LOGS.
+func bodyForLog(ctx context.Context, body []byte) string {
+	if shouldRedact(ctx) {
+		return redact(string(body))
+	}
+	if cfg.SplitReasoning && cfg.OmitReasoningFromLogs {
+		return cfg.ReasoningPattern.ReplaceAllString(string(body), "[reasoning omitted]")
+	}
+	return string(body)
+}
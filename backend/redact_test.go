@@ -0,0 +1,59 @@
+package main
+
+import (
+	"bytes"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestPrivateRequest(t *testing.T) {
+	var webhookCalls atomic.Int32
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		webhookCalls.Add(1)
+		w.Write([]byte(`{"answer": "rewritten"}`))
+	}))
+	t.Cleanup(webhook.Close)
+
+	var upstreamCalls atomic.Int32
+	app := newTestApp(t, func(w http.ResponseWriter, r *http.Request) {
+		upstreamCalls.Add(1)
+		writeCompletion(w, "the confidential answer, long enough to page")
+	}, map[string]string{
+		"PAGE_SIZE_CHARS":          "10",
+		"ENABLE_SUGGESTIONS":       "true",
+		"POST_PROCESS_WEBHOOK_URL": webhook.URL,
+	})
+	pagedAnswers = newStore[string, *pagedAnswer]()
+
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+
+	status, body := postChat(t, app, "/chat/", `{"question": "my confidential question", "private": true, "paginate": true}`)
+	if status != http.StatusOK {
+		t.Fatalf("got %d %v, want 200", status, body)
+	}
+	if strings.Contains(logs.String(), "confidential") {
+		t.Errorf("private content logged:\n%s", logs.String())
+	}
+	if !strings.Contains(logs.String(), "[redacted sha256:") {
+		t.Errorf("no redacted payload logged:\n%s", logs.String())
+	}
+	if body["answer"] != "the confidential answer, long enough to page" || body["next_page_token"] != nil {
+		t.Errorf("answer = %v, want it whole and unpaged", body)
+	}
+	if n := pagedAnswers.len(); n != 0 {
+		t.Errorf("%d paged answers stored", n)
+	}
+	if n := webhookCalls.Load(); n != 0 {
+		t.Errorf("post-process webhook called %d times", n)
+	}
+	if n := upstreamCalls.Load(); n != 1 {
+		t.Errorf("upstream called %d times, want 1 with no suggestions call", n)
+	}
+}
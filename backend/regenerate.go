@@ -0,0 +1,195 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// regenerateTemperatureBoost is added to the default temperature when
+// re-rolling an answer so the new one is likely to differ.
+const regenerateTemperatureBoost = 0.3
+
+// regenerateHandler re-requests the answer to the last user turn of a
+// conversation. The client sends the prior messages; the trailing assistant
+// turn is dropped and the upstream is asked again at a higher temperature
+// (or the given "temperature"). The response holds the new answer and the
+// messages with it stored as the latest turn.
+func regenerateHandler(c *fiber.Ctx) error {
+	var requestData struct {
+		ConversationID string   `json:"conversation_id"`
+		Temperature    *float64 `json:"temperature"`
+		NoSystemPrompt bool     `json:"no_system_prompt"`
+		AssistantLabel string   `json:"assistant_label"`
+		Private        bool     `json:"private"`
+		Profile        string   `json:"profile"`
+		User           string   `json:"user"`
+		Priority       string   `json:"priority"`
+		Messages       []struct {
+			Role    string `json:"role"`
+			Content string `json:"content"`
+		} `json:"messages"`
+	}
+
+	if err := parseJSONBody(c, &requestData); err != nil {
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request body",
+		})
+	}
+
+	if requestData.ConversationID != "" {
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{
+			"error": "Conversations are not stored on the server, send the prior messages instead",
+		})
+	}
+
+	if utf8.RuneCountInString(requestData.User) > maxUserChars {
+		return errorResponse(c, errInvalidUser)
+	}
+
+	priority, ok := parsePriority(requestData.Priority)
+	if !ok {
+		return errorResponse(c, errInvalidPriority)
+	}
+
+	assistantLabel, ok := parseAssistantLabel(requestData.AssistantLabel)
+	if !ok {
+		return errorResponse(c, errInvalidAssistantLabel)
+	}
+
+	profileName := requestData.Profile
+	if profileName == "" {
+		profileName = c.Get("X-Profile")
+	}
+	selected, err := selectProfile(profileName)
+	if err != nil {
+		return errorResponse(c, err)
+	}
+
+	temperature := defaultTemperature + regenerateTemperatureBoost
+	if selected != nil && selected.Temperature != nil {
+		temperature = min(*selected.Temperature+regenerateTemperatureBoost, 2)
+	}
+	if requestData.Temperature != nil {
+		temperature = *requestData.Temperature
+		if temperature < 0 || temperature > 2 {
+			return c.Status(http.StatusBadRequest).JSON(fiber.Map{
+				"error": "Invalid temperature, expected a value between 0 and 2",
+			})
+		}
+	}
+
+	// The frontend labels assistant turns "bot"; the upstream expects
+	// "assistant"
+	messages := []map[string]string{}
+	for _, message := range requestData.Messages {
+		role := message.Role
+		if role == "bot" {
+			role = "assistant"
+		}
+		if role != "system" && role != "user" && role != "assistant" {
+			return c.Status(http.StatusBadRequest).JSON(fiber.Map{
+				"error": fmt.Sprintf("Invalid message role %q", message.Role),
+			})
+		}
+		messages = append(messages, map[string]string{
+			"role":    role,
+			"content": strings.TrimSpace(message.Content),
+		})
+	}
+
+	// Drop the last assistant turn, which is the answer being replaced and
+	// may itself have been empty
+	if len(messages) > 0 && messages[len(messages)-1]["role"] == "assistant" {
+		messages = messages[:len(messages)-1]
+	}
+	for _, message := range messages {
+		if message["content"] == "" {
+			return c.Status(http.StatusBadRequest).JSON(fiber.Map{
+				"error": "Invalid message content, expected non-empty text",
+			})
+		}
+	}
+	if len(messages) == 0 || messages[len(messages)-1]["role"] != "user" {
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{
+			"error": "Messages must end with a user question, optionally followed by the answer to replace",
+		})
+	}
+
+	question := messages[len(messages)-1]["content"]
+	noteRecent(c, question, nil)
+
+	// The default system prompt is only added when the client sent none of
+	// its own and didn't opt out
+	if messages[0]["role"] != "system" && !requestData.NoSystemPrompt {
+		fallback := currentSystemPrompt()
+		if selected != nil && selected.SystemPrompt != "" {
+			fallback = selected.SystemPrompt
+		}
+		systemPrompt, err := renderPrompt(cfg.SystemTemplate, fallback, promptData{
+			Question: question,
+		})
+		if err != nil {
+			return c.Status(http.StatusInternalServerError).JSON(fiber.Map{
+				"error": fmt.Sprintf("Error rendering system prompt template: %v", err),
+			})
+		}
+		messages = append([]map[string]string{{"role": "system", "content": systemPrompt}}, messages...)
+	}
+
+	requestPayload := newPayload(messages)
+	applyProfile(requestPayload, selected)
+	requestPayload["temperature"] = temperature
+	if cfg.ForwardUser && requestData.User != "" {
+		requestPayload["user"] = requestData.User
+	}
+	downgraded := downgradeForLoad(requestPayload)
+
+	ctx := withPriority(c.UserContext(), priority)
+	if requestData.Private {
+		ctx = withPrivate(ctx)
+	}
+	result, fellBack, err := callUpstreamWithFallback(ctx, requestPayload)
+	if err != nil {
+		return errorResponse(c, err)
+	}
+
+	setRateLimitHeaders(c.Set, result.RateLimit)
+	noteRecent(c, question, result)
+	noteTrace(ctx, c, question, requestPayload, result)
+
+	emptyAnswer := isEmptyAnswer(result.Answer)
+	if emptyAnswer && !cfg.AllowEmptyAnswer {
+		return errorResponse(c, errEmptyAnswer)
+	}
+
+	messages = append(messages, map[string]string{
+		"role":    "assistant",
+		"content": result.Answer,
+	})
+
+	response := fiber.Map{
+		"answer":          result.Answer,
+		"assistant_label": assistantLabel,
+		"messages":        messages,
+	}
+	if cfg.SplitReasoning {
+		response["reasoning"] = result.Reasoning
+	}
+	if emptyAnswer {
+		response["empty_answer"] = true
+	}
+	if fellBack {
+		c.Set("X-Model-Fallback", "true")
+	}
+	if downgraded {
+		c.Set("X-Model-Downgraded", "true")
+	}
+	if fellBack || downgraded {
+		response["model"] = result.Model
+	}
+	return c.JSON(response)
+}
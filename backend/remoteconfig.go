@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// remoteConfigTimeout bounds each fetch of REMOTE_CONFIG_URL.
+const remoteConfigTimeout = 5 * time.Second
+
+// remoteDefaults are the default model and system prompt fetched from
+// REMOTE_CONFIG_URL. Either may be empty, meaning the built-in default.
+type remoteDefaults struct {
+	Model        string `json:"model"`
+	SystemPrompt string `json:"system_prompt"`
+}
+
+var (
+	remoteMu      sync.RWMutex
+	remoteCurrent remoteDefaults
+)
+
+// currentModel returns the model to use when nothing else picks one.
+func currentModel() string {
+	remoteMu.RLock()
+	defer remoteMu.RUnlock()
+	if remoteCurrent.Model != "" {
+		return remoteCurrent.Model
+	}
+	return defaultModel
+}
+
+// currentSystemPrompt returns the system prompt to use when no template,
+// persona or request system_prompt replaces it.
+func currentSystemPrompt() string {
+	remoteMu.RLock()
+	defer remoteMu.RUnlock()
+	if remoteCurrent.SystemPrompt != "" {
+		return remoteCurrent.SystemPrompt
+	}
+	return defaultSystemPrompt
+}
+
+// startRemoteConfig fetches REMOTE_CONFIG_URL once and then every
+// REMOTE_CONFIG_REFRESH_MS (unless that is 0) in the background. A failed
+// fetch keeps the last good config, or the built-in defaults if there never
+// was one.
+func startRemoteConfig() {
+	if cfg.RemoteConfigURL == "" {
+		return
+	}
+
+	refreshRemoteConfig()
+	if cfg.RemoteConfigRefresh == 0 {
+		return
+	}
+	go func() {
+		for range time.Tick(cfg.RemoteConfigRefresh) {
+			refreshRemoteConfig()
+		}
+	}()
+}
+
+func refreshRemoteConfig() {
+	fetched, err := fetchRemoteConfig(cfg.RemoteConfigURL)
+	if err != nil {
+		log.Printf("Error fetching remote config, keeping the last good one: %v\n", err)
+		return
+	}
+
+	remoteMu.Lock()
+	changed := fetched != remoteCurrent
+	remoteCurrent = fetched
+	remoteMu.Unlock()
+	if changed {
+		log.Printf("Loaded remote config: model=%q system_prompt=%d chars\n", fetched.Model, len(fetched.SystemPrompt))
+	}
+}
+
+// fetchRemoteConfig downloads and validates the remote config, a JSON object
+// with optional string fields "model" and "system_prompt".
+func fetchRemoteConfig(url string) (remoteDefaults, error) {
+	client := &http.Client{Timeout: remoteConfigTimeout}
+	resp, err := client.Get(url)
+	if err != nil {
+		return remoteDefaults{}, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return remoteDefaults{}, fmt.Errorf("status %s", resp.Status)
+	}
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return remoteDefaults{}, err
+	}
+
+	var fetched remoteDefaults
+	if err := json.Unmarshal(body, &fetched); err != nil {
+		return remoteDefaults{}, fmt.Errorf("expected an object with string fields model and system_prompt: %v", err)
+	}
+	return fetched, nil
+}
@@ -0,0 +1,587 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"mime"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// requireAcceptedContentType answers 415 for request bodies whose media type
+// isn't in ACCEPTED_CONTENT_TYPES. Accepted bodies are always parsed as JSON,
+// so browsers that send a JSON string body as text/plain still work.
+// multipart/form-data is always let through for file uploads to /chat/.
+func requireAcceptedContentType(c *fiber.Ctx) error {
+	if len(c.Body()) == 0 || isMultipartForm(c) {
+		return c.Next()
+	}
+
+	mediaType, _, err := mime.ParseMediaType(c.Get(fiber.HeaderContentType))
+	if err == nil {
+		for _, accepted := range cfg.AcceptedContentTypes {
+			if mediaType == accepted {
+				return c.Next()
+			}
+		}
+	}
+
+	return c.Status(http.StatusUnsupportedMediaType).JSON(fiber.Map{
+		"error": fmt.Sprintf("Unsupported content type %q, expected one of: %s",
+			c.Get(fiber.HeaderContentType), strings.Join(cfg.AcceptedContentTypes, ", ")),
+	})
+}
+
+// parseJSONBody decodes the request body as JSON regardless of its declared
+// content type, which requireAcceptedContentType has already checked.
+func parseJSONBody(c *fiber.Ctx, v interface{}) error {
+	return json.Unmarshal(c.Body(), v)
+}
+
+// utf8BOM is the byte order mark some clients put ahead of UTF-8 bodies.
+var utf8BOM = []byte("\xef\xbb\xbf")
+
+// requireUTF8Body strips a leading byte order mark from JSON bodies, which
+// would otherwise fail to parse, and rejects bodies that aren't valid UTF-8
+// with a clear error instead of a generic parse failure. Multipart bodies can
+// carry binary uploads and are checked per file instead.
+func requireUTF8Body(c *fiber.Ctx) error {
+	if isMultipartForm(c) {
+		return c.Next()
+	}
+
+	// SetBody resets the buffer c.Body() points into, so it gets a copy
+	body := c.Body()
+	if bytes.HasPrefix(body, utf8BOM) {
+		body = append([]byte(nil), body[len(utf8BOM):]...)
+		c.Request().SetBody(body)
+	}
+	if !utf8.Valid(body) {
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{
+			"error": "Request body must be UTF-8 encoded",
+			"code":  "invalid_encoding",
+		})
+	}
+	return c.Next()
+}
+
+// requireJSONObject rejects JSON bodies whose top-level value is an array or
+// a scalar, which would otherwise fail field extraction with a confusing
+// error. Bodies that aren't valid JSON are left for the handler to report.
+func requireJSONObject(c *fiber.Ctx) error {
+	body := bytes.TrimSpace(c.Body())
+	if len(body) == 0 || body[0] == '{' || !json.Valid(body) {
+		return c.Next()
+	}
+
+	return c.Status(http.StatusBadRequest).JSON(fiber.Map{
+		"error": "Request body must be a JSON object",
+		"code":  "invalid_body_type",
+	})
+}
+
+// boolField returns the optional boolean field key of a request body, or def
+// when it is absent. ok is false when the field is present but not a boolean.
+func boolField(requestData map[string]interface{}, key string, def bool) (value bool, ok bool) {
+	raw, present := requestData[key]
+	if !present || raw == nil {
+		return def, true
+	}
+	value, ok = raw.(bool)
+	return value, ok
+}
+
+// stringField returns the optional string field key of a request body, or ""
+// when it is absent. ok is false when the field is present but not a string.
+func stringField(requestData map[string]interface{}, key string) (value string, ok bool) {
+	raw, present := requestData[key]
+	if !present || raw == nil {
+		return "", true
+	}
+	value, ok = raw.(string)
+	return value, ok
+}
+
+// applyFieldAliases renames legacy fields of a decoded request body to their
+// canonical names per FIELD_ALIASES. When both are sent the canonical field
+// wins.
+func applyFieldAliases(requestData map[string]interface{}) (warnings []string) {
+	for alias, canonical := range cfg.FieldAliases {
+		value, ok := requestData[alias]
+		if !ok {
+			continue
+		}
+		log.Printf("Deprecated request field %q used, send %q instead\n", alias, canonical)
+		warnings = append(warnings, fmt.Sprintf("field %q is deprecated, send %q instead", alias, canonical))
+		delete(requestData, alias)
+		if _, exists := requestData[canonical]; !exists {
+			requestData[canonical] = value
+		}
+	}
+	return warnings
+}
+
+// chatRequest is a validated POST /chat/ body.
+type chatRequest struct {
+	Question            string
+	Language            string
+	Vars                map[string]string
+	Context             []string
+	Persona             string
+	SystemPrompt        string
+	SystemPrefix        string
+	SystemSuffix        string
+	NoSystemPrompt      bool
+	ExtractCode         bool
+	Transliterate       bool
+	TrimAnswer          bool
+	IncludePromptTokens bool
+	AssistantLabel      string
+	// InputTruncated is set when the question was cut to MAX_QUESTION_CHARS
+	// under TRUNCATE_INPUT
+	InputTruncated bool
+	// Profile is the selected configuration profile, or nil for the server
+	// defaults
+	Profile     *profile
+	ProfileName string
+	// Private redacts the request's content from logs and skips publishing
+	// its chat event, the post-processing webhook, pagination and
+	// suggestions
+	Private bool
+	// Metadata is logged and published with the chat event, never sent
+	// upstream
+	Metadata map[string]string
+	// User identifies the end user to the upstream's abuse detection; it is
+	// forwarded as user when set and FORWARD_USER is on
+	User string
+	// Verbosity is "concise", "normal" or "detailed"
+	Verbosity string
+	// Priority is the upstream lane the request queues in, "high" or "low"
+	Priority string
+	// HTML adds the answer rendered from Markdown to sanitized HTML
+	HTML bool
+	// Paginate splits answers longer than PAGE_SIZE_CHARS into pages served
+	// by GET /chat/page
+	Paginate bool
+	// Base64Answer returns the answer base64-encoded, for transports that
+	// can't carry arbitrary text
+	Base64Answer bool
+	// ExpectedPattern, when set, is a regexp the answer must match
+	ExpectedPattern *regexp.Regexp
+	// Model overrides the upstream model; only "echo" can be requested
+	Model string
+	// Tools and ToolChoice are forwarded upstream as tools and tool_choice
+	// when non-nil
+	Tools      []interface{}
+	ToolChoice interface{}
+	// LogitBias is forwarded upstream as logit_bias when non-nil
+	LogitBias map[string]float64
+	// RawPayload is merged over the upstream payload before it is sent
+	RawPayload map[string]interface{}
+	// Warnings describe parts of the request that were ignored or are
+	// deprecated, for POST /chat/validate
+	Warnings []string
+}
+
+// warn logs a warning about the request and keeps it in req.Warnings.
+func (req *chatRequest) warn(format string, args ...interface{}) {
+	message := fmt.Sprintf(format, args...)
+	log.Printf("Warning: %s\n", message)
+	req.Warnings = append(req.Warnings, message)
+}
+
+// badRequest is a 400 apiError.
+func badRequest(format string, args ...interface{}) error {
+	return &apiError{Status: http.StatusBadRequest, Message: fmt.Sprintf(format, args...)}
+}
+
+// parseChatRequest validates the fields of a decoded chat request body.
+// profileHeader is the request's X-Profile header, used when the body names
+// no profile.
+func parseChatRequest(requestData map[string]interface{}, profileHeader string) (*chatRequest, error) {
+	req := &chatRequest{}
+	var ok bool
+
+	// A whitespace-only question is treated as empty
+	req.Question, ok = requestData["question"].(string)
+	req.Question = strings.TrimSpace(req.Question)
+	if !ok || req.Question == "" {
+		return nil, badRequest("Invalid question format or empty question")
+	}
+	if size := utf8.RuneCountInString(req.Question); cfg.MaxQuestionChars > 0 && size > cfg.MaxQuestionChars {
+		if !cfg.TruncateInput {
+			return nil, badRequest("Question too long: %d characters, the limit is %d", size, cfg.MaxQuestionChars)
+		}
+		req.Question = string([]rune(req.Question)[:cfg.MaxQuestionChars])
+		req.InputTruncated = true
+		req.warn("question truncated from %d to %d characters", size, cfg.MaxQuestionChars)
+	}
+
+	var err error
+	profileName, ok := stringField(requestData, "profile")
+	if !ok {
+		return nil, badRequest("Invalid profile format, expected a string")
+	}
+	if profileName == "" {
+		profileName = profileHeader
+	}
+	if req.Profile, err = selectProfile(profileName); err != nil {
+		return nil, err
+	}
+	if req.Profile != nil && profileName == "" {
+		profileName = defaultProfileName
+	}
+	req.ProfileName = profileName
+
+	if req.Language, ok = stringField(requestData, "language"); !ok {
+		return nil, badRequest("Invalid language format")
+	}
+
+	if req.Vars, ok = parseVars(requestData["vars"]); !ok {
+		return nil, badRequest("Invalid vars format, expected an object of strings")
+	}
+
+	if req.Persona, ok = stringField(requestData, "persona"); !ok {
+		return nil, badRequest("Invalid persona format, expected a string")
+	}
+	if _, known := cfg.Personas[req.Persona]; req.Persona != "" && !known {
+		return nil, badRequest("Unknown persona %q", req.Persona)
+	}
+
+	if req.SystemPrompt, ok = stringField(requestData, "system_prompt"); !ok {
+		return nil, badRequest("Invalid system_prompt format, expected a string")
+	}
+
+	if req.SystemPrefix, ok = stringField(requestData, "system_prefix"); !ok {
+		return nil, badRequest("Invalid system_prefix format, expected a string")
+	}
+	if req.SystemSuffix, ok = stringField(requestData, "system_suffix"); !ok {
+		return nil, badRequest("Invalid system_suffix format, expected a string")
+	}
+	if size := utf8.RuneCountInString(req.SystemPrefix) + utf8.RuneCountInString(req.SystemSuffix); size > cfg.MaxSystemAffixChars {
+		return nil, badRequest("system_prefix and system_suffix too long: %d characters, the limit is %d", size, cfg.MaxSystemAffixChars)
+	}
+
+	if req.ExtractCode, ok = boolField(requestData, "extract_code", cfg.ExtractCode); !ok {
+		return nil, badRequest("Invalid extract_code format, expected a boolean")
+	}
+
+	if req.Transliterate, ok = boolField(requestData, "transliterate", cfg.Transliterate); !ok {
+		return nil, badRequest("Invalid transliterate format, expected a boolean")
+	}
+
+	req.TrimAnswer = cfg.TrimAnswer
+	if err := applyFeatures(req, requestData["features"]); err != nil {
+		return nil, err
+	}
+
+	if req.IncludePromptTokens, ok = boolField(requestData, "include_prompt_tokens", cfg.VerboseResponse); !ok {
+		return nil, badRequest("Invalid include_prompt_tokens format, expected a boolean")
+	}
+
+	if req.NoSystemPrompt, ok = boolField(requestData, "no_system_prompt", false); !ok {
+		return nil, badRequest("Invalid no_system_prompt format, expected a boolean")
+	}
+
+	if req.Private, ok = boolField(requestData, "private", false); !ok {
+		return nil, badRequest("Invalid private format, expected a boolean")
+	}
+
+	contextSnippets, contextSize, ok := parseContext(requestData["context"])
+	if !ok {
+		return nil, badRequest("Invalid context format, expected an array of strings")
+	}
+	if limit := req.Profile.maxContextChars(); contextSize > limit {
+		return nil, badRequest("Context too long: %d characters, the limit is %d", contextSize, limit)
+	}
+	req.Context = contextSnippets
+
+	if req.AssistantLabel, ok = stringField(requestData, "assistant_label"); !ok {
+		return nil, badRequest("Invalid assistant_label format, expected a string")
+	}
+	if req.AssistantLabel, ok = parseAssistantLabel(req.AssistantLabel); !ok {
+		return nil, errInvalidAssistantLabel
+	}
+
+	if req.Model, ok = stringField(requestData, "model"); !ok {
+		return nil, badRequest("Invalid model format, expected a string")
+	}
+	if req.Model != "" && (req.Model != echoModel || !cfg.EnableEchoModel) {
+		return nil, badRequest("Unsupported model %q", req.Model)
+	}
+
+	req.Metadata = parseMetadata(requestData["metadata"], req.warn)
+
+	if req.User, ok = stringField(requestData, "user"); !ok || utf8.RuneCountInString(req.User) > maxUserChars {
+		return nil, errInvalidUser
+	}
+
+	if req.Verbosity, ok = stringField(requestData, "verbosity"); !ok {
+		return nil, badRequest("Invalid verbosity format, expected a string")
+	}
+	if req.Verbosity == "" {
+		req.Verbosity = "normal"
+	}
+	if _, known := cfg.VerbosityInstructions[req.Verbosity]; !known {
+		return nil, badRequest("Unknown verbosity %q, expected \"concise\", \"normal\" or \"detailed\"", req.Verbosity)
+	}
+
+	if req.Priority, ok = stringField(requestData, "priority"); !ok {
+		return nil, errInvalidPriority
+	}
+	if req.Priority, ok = parsePriority(req.Priority); !ok {
+		return nil, errInvalidPriority
+	}
+
+	format, ok := stringField(requestData, "format")
+	switch {
+	case !ok:
+		return nil, badRequest("Invalid format format, expected a string")
+	case format == "html":
+		req.HTML = true
+	case format != "" && format != "markdown":
+		return nil, badRequest("Unsupported format %q, expected \"markdown\" or \"html\"", format)
+	}
+
+	if req.Paginate, ok = boolField(requestData, "paginate", false); !ok {
+		return nil, badRequest("Invalid paginate format, expected a boolean")
+	}
+
+	encoding, ok := stringField(requestData, "encoding")
+	switch {
+	case !ok:
+		return nil, badRequest("Invalid encoding format, expected a string")
+	case encoding == "base64":
+		req.Base64Answer = true
+	case encoding != "" && encoding != "utf-8":
+		return nil, badRequest("Unsupported encoding %q, expected \"utf-8\" or \"base64\"", encoding)
+	}
+
+	pattern, ok := stringField(requestData, "expected_pattern")
+	if !ok {
+		return nil, badRequest("Invalid expected_pattern format, expected a string")
+	}
+	if req.ExpectedPattern, err = compileExpectedPattern(pattern); err != nil {
+		return nil, err
+	}
+
+	if req.Tools, req.ToolChoice, ok = parseTools(requestData["tools"], requestData["tool_choice"]); !ok {
+		return nil, badRequest("Invalid tools format, expected an array of objects and tool_choice as a string or object")
+	}
+
+	if req.LogitBias, ok = parseLogitBias(requestData["logit_bias"]); !ok {
+		return nil, badRequest("Invalid logit_bias format, expected an object of integer token ids to numbers between -100 and 100")
+	}
+
+	if req.RawPayload, err = parseRawPayload(requestData["raw_payload"]); err != nil {
+		return nil, err
+	}
+
+	return req, nil
+}
+
+// rawPayloadBlockedKeys can't be set through raw_payload: the model is
+// restricted to what "model" allows, messages are built from the prompt
+// fields, a streamed response couldn't be parsed, and the rest have request
+// fields of their own whose checks raw_payload would skip (logit_bias's
+// ranges, FORWARD_USER for user, the tools validation).
+var rawPayloadBlockedKeys = []string{"model", "messages", "stream", "logit_bias", "user", "tools", "tool_choice"}
+
+// parseRawPayload validates the request's "raw_payload" object, which needs
+// ALLOW_RAW_PAYLOAD.
+func parseRawPayload(raw interface{}) (map[string]interface{}, error) {
+	if raw == nil {
+		return nil, nil
+	}
+	if !cfg.AllowRawPayload {
+		return nil, badRequest("raw_payload is not enabled on this server")
+	}
+
+	payload, ok := raw.(map[string]interface{})
+	if !ok {
+		return nil, badRequest("Invalid raw_payload format, expected an object")
+	}
+	for _, key := range rawPayloadBlockedKeys {
+		if _, present := payload[key]; present {
+			return nil, badRequest("raw_payload can't set %q", key)
+		}
+	}
+	return payload, nil
+}
+
+// applyFeatures applies the request's "features" object, whose boolean flags
+// toggle answer post-processing for this request only. Unknown flags are
+// logged and ignored so the frontend can send flags newer than the server.
+func applyFeatures(req *chatRequest, raw interface{}) error {
+	if raw == nil {
+		return nil
+	}
+
+	features, ok := raw.(map[string]interface{})
+	if !ok {
+		return badRequest("Invalid features format, expected an object")
+	}
+	flags := map[string]*bool{
+		"extract_code":  &req.ExtractCode,
+		"transliterate": &req.Transliterate,
+		"trim_answer":   &req.TrimAnswer,
+	}
+	for name, value := range features {
+		flag, known := flags[name]
+		if !known {
+			req.warn("ignoring unknown feature %q", name)
+			continue
+		}
+		b, ok := value.(bool)
+		if !ok {
+			return badRequest("Invalid features.%s format, expected a boolean", name)
+		}
+		*flag = b
+	}
+	return nil
+}
+
+// Limits on a request's "metadata" object.
+const (
+	maxMetadataKeys       = 10
+	maxMetadataKeyChars   = 64
+	maxMetadataValueChars = 256
+)
+
+// parseMetadata keeps the entries of the request's "metadata" object that are
+// strings within the size limits, up to maxMetadataKeys of them. Anything else
+// is dropped with a warning rather than failing the request, since metadata
+// is only for correlating logs.
+func parseMetadata(raw interface{}, warn func(format string, args ...interface{})) map[string]string {
+	if raw == nil {
+		return nil
+	}
+	obj, ok := raw.(map[string]interface{})
+	if !ok {
+		warn("ignoring metadata, expected an object of strings")
+		return nil
+	}
+
+	keys := make([]string, 0, len(obj))
+	for key := range obj {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	metadata := map[string]string{}
+	for _, key := range keys {
+		value, ok := obj[key].(string)
+		switch {
+		case !ok || key == "" || utf8.RuneCountInString(key) > maxMetadataKeyChars || utf8.RuneCountInString(value) > maxMetadataValueChars:
+			warn("ignoring metadata key %q, expected a string of up to %d characters", key, maxMetadataValueChars)
+		case len(metadata) == maxMetadataKeys:
+			warn("ignoring metadata key %q, at most %d keys are kept", key, maxMetadataKeys)
+		default:
+			metadata[key] = value
+		}
+	}
+	return metadata
+}
+
+// maxUserChars caps the length of a request's user identifier.
+const maxUserChars = 256
+
+var errInvalidUser = badRequest("Invalid user, expected a string of up to %d characters", maxUserChars)
+
+// maxPatternChars caps the length of a request's expected_pattern.
+const maxPatternChars = 512
+
+// compileExpectedPattern compiles a client-supplied answer pattern. Go's RE2
+// engine matches in linear time, so a hostile pattern can't backtrack
+// forever; the length cap bounds the compiled program's size as well.
+func compileExpectedPattern(pattern string) (*regexp.Regexp, error) {
+	if pattern == "" {
+		return nil, nil
+	}
+	if utf8.RuneCountInString(pattern) > maxPatternChars {
+		return nil, badRequest("expected_pattern too long, the limit is %d characters", maxPatternChars)
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, badRequest("Invalid expected_pattern: %v", err)
+	}
+	return re, nil
+}
+
+// maxAssistantLabelChars caps the length of a request's assistant_label.
+const maxAssistantLabelChars = 64
+
+var errInvalidAssistantLabel = badRequest("Invalid assistant_label, expected up to %d letters, digits, spaces, '-', '_' or '.'", maxAssistantLabelChars)
+
+// parseAssistantLabel validates the label multi-bot clients use to attribute
+// an answer, defaulting to "assistant" when it is empty.
+func parseAssistantLabel(label string) (string, bool) {
+	if label == "" {
+		return "assistant", true
+	}
+	if utf8.RuneCountInString(label) > maxAssistantLabelChars {
+		return "", false
+	}
+	for _, r := range label {
+		if !unicode.IsLetter(r) && !unicode.IsDigit(r) && !strings.ContainsRune(" -_.", r) {
+			return "", false
+		}
+	}
+	return label, true
+}
+
+// parseTools validates the request's "tools" array of tool definitions and
+// its "tool_choice". Their contents are left for the upstream to check.
+func parseTools(rawTools, rawChoice interface{}) (tools []interface{}, choice interface{}, ok bool) {
+	if rawTools != nil {
+		if tools, ok = rawTools.([]interface{}); !ok {
+			return nil, nil, false
+		}
+		for _, tool := range tools {
+			if _, ok := tool.(map[string]interface{}); !ok {
+				return nil, nil, false
+			}
+		}
+	}
+
+	switch rawChoice.(type) {
+	case nil, string, map[string]interface{}:
+		return tools, rawChoice, true
+	default:
+		return nil, nil, false
+	}
+}
+
+// parseLogitBias validates the request's "logit_bias" object of token id to
+// bias. It returns nil when the field is absent.
+func parseLogitBias(raw interface{}) (map[string]float64, bool) {
+	if raw == nil {
+		return nil, true
+	}
+
+	obj, ok := raw.(map[string]interface{})
+	if !ok {
+		return nil, false
+	}
+	bias := map[string]float64{}
+	for token, value := range obj {
+		if _, err := strconv.ParseUint(token, 10, 32); err != nil {
+			return nil, false
+		}
+		f, ok := value.(float64)
+		if !ok || f < -100 || f > 100 {
+			return nil, false
+		}
+		bias[token] = f
+	}
+	return bias, true
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestRequireJSONObject(t *testing.T) {
+	app := newTestApp(t, answerWith("hello"), nil)
+	tests := []struct {
+		name string
+		body string
+	}{
+		{"array", `[{"question": "hello"}]`},
+		{"string", `"hello"`},
+		{"number", `42`},
+		{"null", `null`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			status, body := postChat(t, app, "/chat/", tt.body)
+			if status != http.StatusBadRequest || body["code"] != "invalid_body_type" {
+				t.Errorf("got %d %v, want 400 invalid_body_type", status, body)
+			}
+		})
+	}
+
+	if status, body := postChat(t, app, "/chat/", `{"question": "hello"}`); status != http.StatusOK {
+		t.Errorf("object body: got %d %v, want 200", status, body)
+	}
+}
+
+func TestRequireUTF8Body(t *testing.T) {
+	app := newTestApp(t, answerWith("hello"), nil)
+	tests := []struct {
+		name       string
+		body       string
+		wantStatus int
+		wantCode   interface{}
+	}{
+		{"invalid bytes", "{\"question\": \"caf\xe9\"}", http.StatusBadRequest, "invalid_encoding"},
+		{"truncated sequence", "{\"question\": \"\xe2\x82\"}", http.StatusBadRequest, "invalid_encoding"},
+		{"BOM stripped", "\xef\xbb\xbf{\"question\": \"café\"}", http.StatusOK, nil},
+		{"plain UTF-8", `{"question": "café"}`, http.StatusOK, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			status, body := postChat(t, app, "/chat/", tt.body)
+			if status != tt.wantStatus || body["code"] != tt.wantCode {
+				t.Errorf("got %d %v, want %d %v", status, body, tt.wantStatus, tt.wantCode)
+			}
+		})
+	}
+}
+
+func TestRawPayloadBlockedKeys(t *testing.T) {
+	app := newTestApp(t, answerWith("hello"), map[string]string{"ALLOW_RAW_PAYLOAD": "true"})
+	tests := []struct {
+		rawPayload string
+		wantStatus int
+	}{
+		{`{"seed": 42}`, http.StatusOK},
+		{`{"model": "other"}`, http.StatusBadRequest},
+		{`{"stream": true}`, http.StatusBadRequest},
+		{`{"logit_bias": {"50256": 500}}`, http.StatusBadRequest},
+		{`{"user": "someone"}`, http.StatusBadRequest},
+		{`{"tools": []}`, http.StatusBadRequest},
+		{`{"tool_choice": "auto"}`, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.rawPayload, func(t *testing.T) {
+			status, body := postChat(t, app, "/chat/", `{"question": "hello", "raw_payload": `+tt.rawPayload+`}`)
+			if status != tt.wantStatus {
+				t.Errorf("got %d %v, want %d", status, body, tt.wantStatus)
+			}
+		})
+	}
+}
+
+func TestWhitespaceOnlyContent(t *testing.T) {
+	app := newTestApp(t, answerWith("hello"), nil)
+	tests := []struct {
+		name       string
+		path       string
+		body       string
+		wantStatus int
+	}{
+		{"spaces question", "/chat/", `{"question": "   "}`, http.StatusBadRequest},
+		{"newline and tab question", "/chat/", `{"question": "\n\t"}`, http.StatusBadRequest},
+		{"normal question", "/chat/", `{"question": "What is Go?"}`, http.StatusOK},
+		{"spaces tokens text", "/tokens/estimate", `{"text": "   "}`, http.StatusBadRequest},
+		{"newline and tab tokens message", "/tokens/estimate", `{"messages": [{"role": "user", "content": "\n\t"}]}`, http.StatusBadRequest},
+		{"normal tokens message", "/tokens/estimate", `{"messages": [{"role": "user", "content": "What is Go?"}]}`, http.StatusOK},
+		{"spaces regenerate question", "/chat/regenerate", `{"messages": [{"role": "user", "content": "   "}]}`, http.StatusBadRequest},
+		{"newline and tab earlier regenerate turn", "/chat/regenerate", `{"messages": [{"role": "user", "content": "\n\t"}, {"role": "assistant", "content": "Hi"}, {"role": "user", "content": "What is Go?"}]}`, http.StatusBadRequest},
+		{"normal regenerate question", "/chat/regenerate", `{"messages": [{"role": "user", "content": "What is Go?"}, {"role": "assistant", "content": ""}]}`, http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if status, body := postChat(t, app, tt.path, tt.body); status != tt.wantStatus {
+				t.Errorf("got %d %v, want %d", status, body, tt.wantStatus)
+			}
+		})
+	}
+}
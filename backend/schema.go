@@ -0,0 +1,20 @@
+package main
+
+import (
+	_ "embed"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// apiSchema holds the JSON schemas of the /chat/ request and of success and
+// error responses. Bump its "version" on breaking changes.
+//
+//go:embed schema.json
+var apiSchema []byte
+
+// schemaHandler serves apiSchema.
+func schemaHandler(c *fiber.Ctx) error {
+	c.Set(fiber.HeaderContentType, fiber.MIMEApplicationJSON)
+	c.Set(fiber.HeaderCacheControl, "public, max-age=3600")
+	return c.Send(apiSchema)
+}
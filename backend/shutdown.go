@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Each shutdown step gets its own deadline so one stuck step can't hold up
+// the rest.
+const (
+	drainTimeout = 10 * time.Second
+	flushTimeout = 3 * time.Second
+)
+
+// waitForShutdown blocks until SIGINT or SIGTERM, then fails readiness checks
+// for SHUTDOWN_READY_DELAY_MS, stops accepting connections, waits for
+// in-flight requests, and flushes anything buffered for NATS and the trace
+// exporter before returning.
+func waitForShutdown(app *fiber.App) {
+	quit := make(chan os.Signal, 1)
+	signal.Notify(quit, os.Interrupt, syscall.SIGTERM)
+	sig := <-quit
+
+	log.Printf("Received %s, shutting down\n", sig)
+
+	// Give load balancers time to see /health/ready fail before the listener
+	// closes; requests keep being served meanwhile
+	shuttingDown.Store(true)
+	if cfg.ShutdownReadyDelay > 0 {
+		log.Printf("Shutdown: failing readiness for %s before draining\n", cfg.ShutdownReadyDelay)
+		time.Sleep(cfg.ShutdownReadyDelay)
+	}
+
+	log.Println("Shutdown: draining in-flight requests")
+	if err := app.ShutdownWithTimeout(drainTimeout); err != nil {
+		log.Printf("Shutdown: error draining requests: %v\n", err)
+	}
+
+	if natsConn != nil {
+		log.Println("Shutdown: flushing NATS connection")
+		if err := natsConn.FlushTimeout(flushTimeout); err != nil {
+			log.Printf("Shutdown: error flushing NATS: %v\n", err)
+		}
+		natsConn.Close()
+	}
+
+	if tracerProvider != nil {
+		log.Println("Shutdown: flushing traces")
+		ctx, cancel := context.WithTimeout(context.Background(), flushTimeout)
+		if err := tracerProvider.Shutdown(ctx); err != nil {
+			log.Printf("Shutdown: error flushing traces: %v\n", err)
+		}
+		cancel()
+	}
+
+	log.Println("Shutdown complete")
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// verifySignature requires, when WEBHOOK_SIGNING_SECRET is set, an
+// X-Signature header holding the hex HMAC-SHA256 of the raw request body under
+// that secret, optionally prefixed "sha256=". Requests without a valid one get
+// 401 before anything reads the body. Preflights carry no body and pass.
+func verifySignature(c *fiber.Ctx) error {
+	if cfg.SigningSecret == "" || c.Method() == fiber.MethodOptions {
+		return c.Next()
+	}
+
+	signature := strings.TrimPrefix(c.Get("X-Signature"), "sha256=")
+	got, err := hex.DecodeString(signature)
+	mac := hmac.New(sha256.New, []byte(cfg.SigningSecret))
+	mac.Write(c.Body())
+	if err != nil || !hmac.Equal(got, mac.Sum(nil)) {
+		return c.Status(http.StatusUnauthorized).JSON(fiber.Map{
+			"error": "Missing or invalid X-Signature",
+			"code":  "invalid_signature",
+		})
+	}
+	return c.Next()
+}
@@ -0,0 +1,64 @@
+package main
+
+import "sync"
+
+// store is a mutex-guarded map for state shared between requests (per-client
+// counters, stored pages), so features don't each hand-roll the locking
+// around a map. Every access goes through its methods. State that isn't
+// keyed, like a ring buffer, a running total or a file, keeps its own lock
+// next to the code that owns it.
+type store[K comparable, V any] struct {
+	mu      sync.Mutex
+	entries map[K]V
+}
+
+func newStore[K comparable, V any]() *store[K, V] {
+	return &store[K, V]{entries: map[K]V{}}
+}
+
+// get returns the value stored under key, if any.
+func (s *store[K, V]) get(key K) (V, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	value, ok := s.entries[key]
+	return value, ok
+}
+
+// set stores value under key.
+func (s *store[K, V]) set(key K, value V) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.entries[key] = value
+}
+
+// update replaces the value under key with what fn returns for the current
+// one, or deletes it when fn returns keep false, all under one lock so the
+// read and the write can't interleave with another request's.
+func (s *store[K, V]) update(key K, fn func(value V, ok bool) (next V, keep bool)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	value, ok := s.entries[key]
+	if next, keep := fn(value, ok); keep {
+		s.entries[key] = next
+	} else {
+		delete(s.entries, key)
+	}
+}
+
+// deleteIf deletes every entry fn reports true for.
+func (s *store[K, V]) deleteIf(fn func(key K, value V) bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for key, value := range s.entries {
+		if fn(key, value) {
+			delete(s.entries, key)
+		}
+	}
+}
+
+// len returns the number of entries.
+func (s *store[K, V]) len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.entries)
+}
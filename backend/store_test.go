@@ -0,0 +1,102 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func TestStoreUpdate(t *testing.T) {
+	s := newStore[string, int]()
+	increment := func(count int, _ bool) (int, bool) { return count + 1, true }
+	decrement := func(count int, _ bool) (int, bool) { return count - 1, count > 1 }
+
+	s.update("a", increment)
+	s.update("a", increment)
+	if count, _ := s.get("a"); count != 2 {
+		t.Fatalf("count = %d, want 2", count)
+	}
+	s.update("a", decrement)
+	s.update("a", decrement)
+	if _, ok := s.get("a"); ok || s.len() != 0 {
+		t.Fatalf("entry kept at 0, len = %d", s.len())
+	}
+}
+
+// TestChatHandlerConcurrent hammers /chat with every feature that keeps
+// shared state turned on; run it with -race.
+func TestChatHandlerConcurrent(t *testing.T) {
+	canned := filepath.Join(t.TempDir(), "canned.json")
+	if err := os.WriteFile(canned, []byte(`{"what are your hours": "Nine to five, every day of the week."}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	remote := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"system_prompt": "You are a test assistant."}`))
+	}))
+	t.Cleanup(remote.Close)
+	app := newTestApp(t, answerWith("a fairly long answer that gets split into several pages"), map[string]string{
+		"NVIDIA_API_KEYS":           "key-a,key-b",
+		"MAX_CONCURRENT_PER_CLIENT": "1000",
+		"DEBUG_ENDPOINTS":           "true",
+		"DEBUG_TOKEN":               "secret",
+		"DEBUG_RECENT_SIZE":         "16",
+		"PAGE_SIZE_CHARS":           "10",
+		"CANNED_ANSWERS_PATH":       canned,
+		"UPSTREAM_ERROR_ALERT_RATE": "0.5",
+		"VERBOSE_RESPONSE":          "true",
+		"MODEL_PRICING":             defaultModel + ":1:2",
+		"ENABLE_SUGGESTIONS":        "true",
+		"TRACE_FILE_PATH":           filepath.Join(t.TempDir(), "trace.jsonl"),
+		"REMOTE_CONFIG_URL":         remote.URL,
+	})
+	openTraceFile()
+	t.Cleanup(func() {
+		traceFile.file.Close()
+		traceFile.file = nil
+		remoteCurrent = remoteDefaults{}
+	})
+
+	bodies := []string{
+		`{"question": "hello there", "paginate": true}`,
+		`{"question": "What are your hours?"}`,
+		`{"question": "hi", "priority": "low", "metadata": {"a": "b"}}`,
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 60; i++ {
+		wg.Add(4)
+		go func(i int) {
+			defer wg.Done()
+			status, body := postChat(t, app, "/chat/", bodies[i%len(bodies)])
+			if status != http.StatusOK {
+				t.Errorf("POST /chat/ = %d %v", status, body)
+			}
+			if token, ok := body["next_page_token"].(string); ok {
+				req, _ := http.NewRequest(http.MethodGet, "/chat/page?token="+token, nil)
+				doRequest(t, app, req)
+			}
+		}(i)
+		go func() {
+			defer wg.Done()
+			refreshRemoteConfig()
+		}()
+		go func() {
+			defer wg.Done()
+			req, _ := http.NewRequest(http.MethodGet, "/stats", nil)
+			doRequest(t, app, req)
+		}()
+		go func() {
+			defer wg.Done()
+			req, _ := http.NewRequest(http.MethodGet, "/debug/recent", nil)
+			req.Header.Set("Authorization", "Bearer secret")
+			doRequest(t, app, req)
+		}()
+	}
+	wg.Wait()
+
+	if n := inFlight.len(); n != 0 {
+		t.Errorf("%d clients still counted in flight", n)
+	}
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"context"
+	"log"
+	"strings"
+)
+
+// maxSuggestions is how many follow-up questions a response carries.
+const maxSuggestions = 3
+
+const suggestionsPrompt = "Suggest up to 3 short follow-up questions the user might ask next about this exchange. Reply with one question per line and nothing else."
+
+// suggestFollowUps asks SUGGESTIONS_MODEL for follow-up questions to question
+// and answer. It fails open: on an upstream error it logs and returns none.
+func suggestFollowUps(ctx context.Context, question, answer string) []string {
+	payload := newPayload([]map[string]string{
+		{"role": "system", "content": suggestionsPrompt},
+		{"role": "user", "content": question},
+		{"role": "assistant", "content": answer},
+		{"role": "user", "content": "What could I ask next?"},
+	})
+	payload["model"] = cfg.SuggestionsModel
+	payload["max_tokens"] = 128
+
+	result, err := callUpstream(ctx, payload)
+	if err != nil {
+		log.Printf("Error generating follow-up suggestions, leaving them out: %v\n", err)
+		return nil
+	}
+	return parseSuggestions(result.Answer)
+}
+
+// parseSuggestions takes up to maxSuggestions questions from the model's
+// reply, one per line, without any list markers it added.
+func parseSuggestions(reply string) []string {
+	suggestions := []string{}
+	for _, line := range strings.Split(reply, "\n") {
+		line = strings.TrimSpace(strings.TrimLeft(strings.TrimSpace(line), "-*•0123456789.) "))
+		if line == "" {
+			continue
+		}
+		suggestions = append(suggestions, line)
+		if len(suggestions) == maxSuggestions {
+			break
+		}
+	}
+	return suggestions
+}
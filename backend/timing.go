@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// requestTiming accumulates how long a request spent in each phase, summed
+// over retries, for its Server-Timing header.
+type requestTiming struct {
+	mu       sync.Mutex
+	upstream time.Duration
+	parse    time.Duration
+}
+
+type timingKey struct{}
+
+// addTiming adds d to the named phase ("upstream" or "parse") of the request
+// behind ctx, if it is being timed.
+func addTiming(ctx context.Context, phase string, d time.Duration) {
+	timing, ok := ctx.Value(timingKey{}).(*requestTiming)
+	if !ok {
+		return
+	}
+	timing.mu.Lock()
+	defer timing.mu.Unlock()
+	switch phase {
+	case "upstream":
+		timing.upstream += d
+	case "parse":
+		timing.parse += d
+	}
+}
+
+// serverTiming times the rest of the chain and reports the upstream, parse
+// and total durations in a Server-Timing header, which browsers show in the
+// network panel.
+func serverTiming(c *fiber.Ctx) error {
+	start := time.Now()
+	timing := &requestTiming{}
+	c.SetUserContext(context.WithValue(c.UserContext(), timingKey{}, timing))
+
+	err := c.Next()
+
+	timing.mu.Lock()
+	metrics := []string{
+		formatServerTiming("upstream", timing.upstream),
+		formatServerTiming("parse", timing.parse),
+		formatServerTiming("total", time.Since(start)),
+	}
+	timing.mu.Unlock()
+	c.Set("Server-Timing", strings.Join(metrics, ", "))
+	// Browsers hide the timings of cross-origin responses without this
+	c.Set("Timing-Allow-Origin", corsConfig.AllowOrigins)
+	return err
+}
+
+// formatServerTiming renders one Server-Timing metric with its duration in
+// milliseconds.
+func formatServerTiming(name string, d time.Duration) string {
+	return fmt.Sprintf("%s;dur=%.1f", name, float64(d.Microseconds())/1000)
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"unicode"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Per-message overhead of the chat format, following OpenAI's published
+// approximation for role/separator tokens.
+const (
+	tokensPerMessage = 4
+	tokensPerReply   = 3
+)
+
+// estimateTokens approximates the BPE token count of text. Runs of Latin
+// letters are counted at roughly four characters per token, digits at three,
+// and every punctuation mark or symbol, which is common in code, as a token of
+// its own. Letters outside ASCII (CJK, etc.) count one token each. It is not
+// exact, but stays close for English prose and source code.
+func estimateTokens(text string) int {
+	tokens := 0
+	letters, digits := 0, 0
+
+	flush := func() {
+		tokens += (letters + 3) / 4
+		tokens += (digits + 2) / 3
+		letters, digits = 0, 0
+	}
+
+	for _, r := range text {
+		switch {
+		case r <= unicode.MaxASCII && unicode.IsLetter(r):
+			if digits > 0 {
+				flush()
+			}
+			letters++
+		case unicode.IsDigit(r):
+			if letters > 0 {
+				flush()
+			}
+			digits++
+		case unicode.IsSpace(r):
+			flush()
+		case unicode.IsLetter(r):
+			flush()
+			tokens++
+		default:
+			flush()
+			tokens++
+		}
+	}
+	flush()
+
+	return tokens
+}
+
+func tokenEstimateHandler(c *fiber.Ctx) error {
+	var requestData struct {
+		Text     string `json:"text"`
+		Messages []struct {
+			Role    string `json:"role"`
+			Content string `json:"content"`
+		} `json:"messages"`
+	}
+
+	if err := parseJSONBody(c, &requestData); err != nil {
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request body",
+		})
+	}
+
+	// Whitespace counts for nothing, so text or a message of only whitespace
+	// is treated as empty
+	if strings.TrimSpace(requestData.Text) == "" && len(requestData.Messages) == 0 {
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{
+			"error": "Provide either text or messages",
+		})
+	}
+	for _, message := range requestData.Messages {
+		if strings.TrimSpace(message.Content) == "" {
+			return c.Status(http.StatusBadRequest).JSON(fiber.Map{
+				"error": "Invalid message content, expected non-empty text",
+			})
+		}
+	}
+
+	tokens := estimateTokens(requestData.Text)
+	if len(requestData.Messages) > 0 {
+		for _, message := range requestData.Messages {
+			tokens += tokensPerMessage + estimateTokens(message.Role) + estimateTokens(message.Content)
+		}
+		tokens += tokensPerReply
+	}
+
+	return c.JSON(fiber.Map{
+		"tokens": tokens,
+	})
+}
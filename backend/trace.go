@@ -0,0 +1,184 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/utils"
+)
+
+// traceRecord is one line of TRACE_FILE_PATH: what happened to a /chat
+// request, enough to reproduce it later. Question and answer are redacted
+// with REDACT_PROMPTS on or for a private request.
+type traceRecord struct {
+	Timestamp    time.Time              `json:"timestamp"`
+	RequestID    string                 `json:"request_id"`
+	Method       string                 `json:"method"`
+	Path         string                 `json:"path"`
+	Status       int                    `json:"status"`
+	Error        string                 `json:"error,omitempty"`
+	LatencyMs    int64                  `json:"latency_ms"`
+	UpstreamMs   float64                `json:"upstream_ms"`
+	ParseMs      float64                `json:"parse_ms"`
+	Model        string                 `json:"model,omitempty"`
+	Params       map[string]interface{} `json:"params,omitempty"`
+	Usage        map[string]interface{} `json:"usage,omitempty"`
+	FinishReason string                 `json:"finish_reason,omitempty"`
+	Question     string                 `json:"question,omitempty"`
+	Answer       string                 `json:"answer,omitempty"`
+}
+
+// traceLocal is the Locals key under which traceRequest leaves the record for
+// the handler to fill in.
+const traceLocal = "trace"
+
+// traceFile appends trace records to TRACE_FILE_PATH, rotating it to
+// TRACE_FILE_PATH.1, .2 and so on once it reaches TRACE_FILE_MAX_MB.
+var traceFile struct {
+	sync.Mutex
+	file *os.File
+	size int64
+}
+
+// openTraceFile opens TRACE_FILE_PATH for appending, if set. Failing to is
+// fatal.
+func openTraceFile() {
+	if cfg.TraceFilePath == "" {
+		return
+	}
+	file, err := os.OpenFile(cfg.TraceFilePath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		log.Fatalf("Error opening TRACE_FILE_PATH: %v\n", err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		log.Fatalf("Error opening TRACE_FILE_PATH: %v\n", err)
+	}
+	traceFile.file, traceFile.size = file, info.Size()
+}
+
+// traceRequest writes a trace record for each request when TRACE_FILE_PATH
+// is set. It must run inside serverTiming to pick up the request's timings.
+func traceRequest(c *fiber.Ctx) error {
+	if traceFile.file == nil {
+		return c.Next()
+	}
+
+	start := time.Now()
+	record := &traceRecord{
+		Timestamp: start,
+		RequestID: fmt.Sprint(c.Locals("requestid")),
+		Method:    utils.CopyString(c.Method()),
+		Path:      utils.CopyString(c.Path()),
+	}
+	c.Locals(traceLocal, record)
+
+	err := c.Next()
+
+	record.LatencyMs = time.Since(start).Milliseconds()
+	record.Status = c.Response().StatusCode()
+	if err != nil {
+		record.Status = http.StatusInternalServerError
+		if fiberErr, ok := err.(*fiber.Error); ok {
+			record.Status = fiberErr.Code
+		}
+		record.Error = err.Error()
+	} else if record.Status >= http.StatusBadRequest {
+		var body struct {
+			Error string `json:"error"`
+		}
+		if json.Unmarshal(c.Response().Body(), &body) == nil {
+			record.Error = body.Error
+		}
+	}
+	if timing, ok := c.UserContext().Value(timingKey{}).(*requestTiming); ok {
+		timing.mu.Lock()
+		record.UpstreamMs = float64(timing.upstream.Microseconds()) / 1000
+		record.ParseMs = float64(timing.parse.Microseconds()) / 1000
+		timing.mu.Unlock()
+	}
+
+	writeTrace(record)
+	return err
+}
+
+// noteTrace adds the question, the upstream parameters and the outcome to
+// the record traceRequest is keeping for the request, if any.
+func noteTrace(ctx context.Context, c *fiber.Ctx, question string, payload map[string]interface{}, result *completion) {
+	record, ok := c.Locals(traceLocal).(*traceRecord)
+	if !ok {
+		return
+	}
+	record.Question, record.Answer = question, result.Answer
+	if shouldRedact(ctx) {
+		record.Question, record.Answer = redact(question), redact(result.Answer)
+	}
+	record.Params = map[string]interface{}{
+		"model":       payload["model"],
+		"temperature": payload["temperature"],
+		"top_p":       payload["top_p"],
+		"max_tokens":  payload["max_tokens"],
+	}
+	record.Model = result.Model
+	record.Usage = result.Usage
+	record.FinishReason = result.FinishReason
+}
+
+// writeTrace appends record to the trace file, rotating it first when the
+// record would take it past TRACE_FILE_MAX_MB. Write errors are logged and
+// the record dropped.
+func writeTrace(record *traceRecord) {
+	line, err := json.Marshal(record)
+	if err != nil {
+		log.Printf("Error encoding trace record: %v\n", err)
+		return
+	}
+	line = append(line, '\n')
+
+	traceFile.Lock()
+	defer traceFile.Unlock()
+	if traceFile.size > 0 && traceFile.size+int64(len(line)) > int64(cfg.TraceFileMaxMB)<<20 {
+		if err := rotateTraceFile(); err != nil {
+			log.Printf("Error rotating TRACE_FILE_PATH: %v\n", err)
+		}
+	}
+	n, err := traceFile.file.Write(line)
+	traceFile.size += int64(n)
+	if err != nil {
+		log.Printf("Error writing trace record: %v\n", err)
+	}
+}
+
+// rotateTraceFile shifts TRACE_FILE_PATH.1 to .2 and so on, dropping the
+// oldest beyond TRACE_FILE_MAX_FILES, moves the current file to .1 and
+// starts a new one. On failure the current file stays in use. traceFile
+// must be locked.
+func rotateTraceFile() error {
+	path := cfg.TraceFilePath
+	if cfg.TraceFileMaxFiles > 0 {
+		os.Remove(fmt.Sprintf("%s.%d", path, cfg.TraceFileMaxFiles))
+		for i := cfg.TraceFileMaxFiles - 1; i >= 1; i-- {
+			os.Rename(fmt.Sprintf("%s.%d", path, i), fmt.Sprintf("%s.%d", path, i+1))
+		}
+		// The open file follows the rename, so it is only closed once its
+		// replacement is open
+		if err := os.Rename(path, path+".1"); err != nil {
+			return err
+		}
+	}
+
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+	traceFile.file.Close()
+	traceFile.file, traceFile.size = file, 0
+	return nil
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"os"
+
+	"github.com/gofiber/fiber/v2"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracer is a no-op until setupTracing installs a real provider.
+var tracer = otel.Tracer("chatbot-backend")
+
+// tracerProvider is nil when tracing is off.
+var tracerProvider *sdktrace.TracerProvider
+
+// setupTracing exports spans over OTLP/HTTP when OTEL_EXPORTER_OTLP_ENDPOINT
+// is set; the exporter reads the endpoint and the other standard OTEL_*
+// variables itself. Without it, every span is a no-op.
+func setupTracing() {
+	if os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT") == "" {
+		return
+	}
+
+	exporter, err := otlptracehttp.New(context.Background())
+	if err != nil {
+		log.Printf("Error creating OTLP exporter, tracing is off: %v\n", err)
+		return
+	}
+
+	tracerProvider = sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewSchemaless(semconv.ServiceName("chatbot-backend"))),
+	)
+	otel.SetTracerProvider(tracerProvider)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	log.Println("Tracing is active")
+}
+
+// tracingMiddleware starts a span per request, continuing the trace from an
+// incoming traceparent header. Handlers reach the span through c.UserContext.
+func tracingMiddleware(c *fiber.Ctx) error {
+	carrier := propagation.HeaderCarrier(http.Header(c.GetReqHeaders()))
+	ctx := otel.GetTextMapPropagator().Extract(c.UserContext(), carrier)
+
+	ctx, span := tracer.Start(ctx, c.Method(), trace.WithSpanKind(trace.SpanKindServer))
+	defer span.End()
+	c.SetUserContext(ctx)
+
+	err := c.Next()
+
+	// The matched route is only known once the handler has run
+	span.SetName(c.Method() + " " + c.Route().Path)
+	status := c.Response().StatusCode()
+	span.SetAttributes(
+		semconv.HTTPRequestMethodKey.String(c.Method()),
+		semconv.URLPath(c.Path()),
+		semconv.HTTPResponseStatusCode(status),
+	)
+	if status >= http.StatusInternalServerError {
+		span.SetStatus(codes.Error, http.StatusText(status))
+	}
+	return err
+}
+
+// startUpstreamSpan starts the child span for an upstream call and injects
+// its traceparent into the outgoing request headers.
+func startUpstreamSpan(ctx context.Context, req *http.Request, model string) (context.Context, trace.Span) {
+	ctx, span := tracer.Start(ctx, "upstream chat completion",
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			attribute.String("llm.model", model),
+			semconv.URLFull(req.URL.String()),
+		),
+	)
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(req.Header))
+	return ctx, span
+}
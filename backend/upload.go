@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"unicode/utf8"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// isMultipartForm reports whether the request body is multipart/form-data.
+func isMultipartForm(c *fiber.Ctx) bool {
+	mediaType, _, err := mime.ParseMediaType(c.Get(fiber.HeaderContentType))
+	return err == nil && mediaType == fiber.MIMEMultipartForm
+}
+
+// multipartBoolFields are the chat request fields that take a boolean.
+var multipartBoolFields = map[string]bool{
+	"extract_code":          true,
+	"include_prompt_tokens": true,
+	"no_system_prompt":      true,
+	"paginate":              true,
+	"private":               true,
+	"transliterate":         true,
+}
+
+// parseMultipartChat turns a multipart/form-data chat request into the same
+// fields a JSON body would have. Form values become string fields, or
+// booleans for the boolean fields, and each uploaded "file" is added to the
+// context, headed by its file name. Files must be UTF-8 text of at most
+// MAX_UPLOAD_BYTES.
+func parseMultipartChat(c *fiber.Ctx) (map[string]interface{}, error) {
+	form, err := c.MultipartForm()
+	if err != nil {
+		return nil, badRequest("Invalid multipart form: %v", err)
+	}
+
+	requestData := map[string]interface{}{}
+	for key, values := range form.Value {
+		if len(values) == 0 {
+			continue
+		}
+		requestData[key] = values[0]
+
+		// Form values are all text, so the boolean fields are converted
+		// here; anything that isn't a boolean is left for validation to
+		// reject
+		name := key
+		if canonical, ok := cfg.FieldAliases[key]; ok {
+			name = canonical
+		}
+		if multipartBoolFields[name] {
+			if value, err := strconv.ParseBool(values[0]); err == nil {
+				requestData[key] = value
+			}
+		}
+	}
+
+	context := []interface{}{}
+	for _, file := range form.File["file"] {
+		if file.Size > int64(cfg.MaxUploadBytes) {
+			return nil, &apiError{
+				Status:  http.StatusRequestEntityTooLarge,
+				Message: fmt.Sprintf("Uploaded file %q is too large: %d bytes, the limit is %d", file.Filename, file.Size, cfg.MaxUploadBytes),
+				Code:    "upload_too_large",
+			}
+		}
+
+		f, err := file.Open()
+		if err != nil {
+			return nil, badRequest("Error reading uploaded file %q: %v", file.Filename, err)
+		}
+		content, err := io.ReadAll(f)
+		f.Close()
+		if err != nil {
+			return nil, badRequest("Error reading uploaded file %q: %v", file.Filename, err)
+		}
+
+		if !utf8.Valid(content) || bytes.IndexByte(content, 0) >= 0 {
+			return nil, &apiError{
+				Status:  http.StatusUnsupportedMediaType,
+				Message: fmt.Sprintf("Uploaded file %q is not a text file", file.Filename),
+				Code:    "upload_not_text",
+			}
+		}
+		context = append(context, fmt.Sprintf("File %s:\n\n%s", file.Filename, content))
+	}
+	if len(context) > 0 {
+		requestData["context"] = context
+	}
+	return requestData, nil
+}
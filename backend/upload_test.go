@@ -0,0 +1,54 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestMultipartBoolFields(t *testing.T) {
+	var messages []interface{}
+	app := newTestApp(t, func(w http.ResponseWriter, r *http.Request) {
+		var payload map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&payload)
+		messages, _ = payload["messages"].([]interface{})
+		writeCompletion(w, "hello")
+	}, map[string]string{"FIELD_ALIASES": "bare:no_system_prompt"})
+
+	tests := []struct {
+		name         string
+		fields       map[string]string
+		wantStatus   int
+		wantMessages int
+	}{
+		{"true", map[string]string{"no_system_prompt": "true", "private": "true"}, http.StatusOK, 1},
+		{"false", map[string]string{"no_system_prompt": "false"}, http.StatusOK, 2},
+		{"alias", map[string]string{"bare": "true"}, http.StatusOK, 1},
+		{"not a bool", map[string]string{"no_system_prompt": "maybe"}, http.StatusBadRequest, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			messages = nil
+			var body bytes.Buffer
+			form := multipart.NewWriter(&body)
+			form.WriteField("question", "hello")
+			for key, value := range tt.fields {
+				form.WriteField(key, value)
+			}
+			form.Close()
+
+			req := httptest.NewRequest(http.MethodPost, "/chat/", &body)
+			req.Header.Set("Content-Type", form.FormDataContentType())
+			status, resp := doRequest(t, app, req)
+			if status != tt.wantStatus {
+				t.Fatalf("got %d %v, want %d", status, resp, tt.wantStatus)
+			}
+			if len(messages) != tt.wantMessages {
+				t.Errorf("upstream got %d messages, want %d", len(messages), tt.wantMessages)
+			}
+		})
+	}
+}
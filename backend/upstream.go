@@ -0,0 +1,566 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"go.opentelemetry.io/otel/codes"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+)
+
+const (
+	defaultModel       = "meta/llama3-70b-instruct"
+	defaultTemperature = 0.5
+)
+
+// newPayload builds an upstream chat completion payload for messages with the
+// default model (which remote config may replace) and sampling parameters.
+func newPayload(messages []map[string]string) map[string]interface{} {
+	return map[string]interface{}{
+		"model":       currentModel(),
+		"messages":    messages,
+		"temperature": defaultTemperature,
+		"top_p":       1,
+		"max_tokens":  1024,
+	}
+}
+
+// upstreamClient sends every upstream request, so connections are reused
+// across calls. It is set up by setupUpstreamClient once the config is
+// loaded.
+var upstreamClient = &http.Client{}
+
+// setupUpstreamClient builds upstreamClient's transport from the config.
+func setupUpstreamClient() {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.ResponseHeaderTimeout = cfg.ResponseHeaderTimeout
+	upstreamClient = &http.Client{Transport: transport, CheckRedirect: checkUpstreamRedirect}
+}
+
+// maxUpstreamRedirects is how many redirects an upstream call follows.
+const maxUpstreamRedirects = 10
+
+// errCrossHostRedirect stops an upstream call redirected to another host,
+// where the client would silently drop the Authorization header.
+var errCrossHostRedirect = errors.New("upstream redirected to another host")
+
+// checkUpstreamRedirect logs every upstream redirect. Redirects to another
+// host fail unless UPSTREAM_REDIRECT_POLICY is "follow", which sends the
+// original headers, API key included, to the new host too.
+func checkUpstreamRedirect(req *http.Request, via []*http.Request) error {
+	log.Printf("Upstream redirected to %s\n", req.URL.Redacted())
+	if len(via) >= maxUpstreamRedirects {
+		return fmt.Errorf("stopped after %d upstream redirects", maxUpstreamRedirects)
+	}
+	if req.URL.Host == via[0].URL.Host {
+		return nil
+	}
+	if cfg.UpstreamRedirectPolicy != "follow" {
+		return errCrossHostRedirect
+	}
+	for key, values := range via[0].Header {
+		req.Header[key] = values
+	}
+	return nil
+}
+
+// isResponseHeaderTimeout reports whether err is the transport giving up on
+// RESPONSE_HEADER_TIMEOUT, as opposed to failing to connect or a slow body.
+// net/http doesn't export that error, so it is matched by its message.
+func isResponseHeaderTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout() &&
+		strings.Contains(err.Error(), "timeout awaiting response headers")
+}
+
+// upstreamTimeout returns the MODEL_TIMEOUTS entry for model, or
+// UPSTREAM_TIMEOUT_MS when it has none. 0 means no timeout.
+func upstreamTimeout(model string) time.Duration {
+	if timeout, ok := cfg.ModelTimeouts[model]; ok {
+		return timeout
+	}
+	return cfg.UpstreamTimeout
+}
+
+// hitTimeout reports whether timeoutCtx ran out on its own, as opposed to the
+// parent context being cancelled by the client going away.
+func hitTimeout(parent, timeoutCtx context.Context) bool {
+	return errors.Is(timeoutCtx.Err(), context.DeadlineExceeded) && parent.Err() == nil
+}
+
+func errUpstreamTimeout(model string, timeout time.Duration) error {
+	log.Printf("Upstream call to %s timed out after %s\n", model, timeout)
+	return &apiError{Status: http.StatusGatewayTimeout, Message: fmt.Sprintf("upstream timed out after %s", timeout), transportFailed: true}
+}
+
+// apiError is an error reported to the client with the given HTTP status.
+type apiError struct {
+	Status  int
+	Message string
+	// Code is an optional machine-readable error code for clients
+	Code string
+
+	// upstreamStatus and retryAfter are the upstream's status and
+	// Retry-After for errors caused by an upstream error response
+	upstreamStatus int
+	retryAfter     time.Duration
+	// transportFailed marks errors where the upstream couldn't be reached or
+	// stopped answering mid-call
+	transportFailed bool
+}
+
+func (e *apiError) Error() string {
+	return e.Message
+}
+
+// errorResponse writes err as a JSON error response, using the status of an
+// apiError and 500 for anything else.
+func errorResponse(c *fiber.Ctx, err error) error {
+	var apiErr *apiError
+	if errors.As(err, &apiErr) {
+		response := fiber.Map{
+			"error": apiErr.Message,
+		}
+		if apiErr.Code != "" {
+			response["code"] = apiErr.Code
+		}
+		return c.Status(apiErr.Status).JSON(response)
+	}
+	return c.Status(http.StatusInternalServerError).JSON(fiber.Map{
+		"error": err.Error(),
+	})
+}
+
+// completion is a successful chat completion from the upstream API.
+type completion struct {
+	Answer       string
+	Model        string
+	FinishReason string
+	Usage        map[string]interface{}
+	// RateLimit is the quota the upstream reported left after this call
+	RateLimit upstreamRateLimit
+	// Reasoning is the chain of thought split off the answer under
+	// SPLIT_REASONING
+	Reasoning string
+	// ToolCalls are the functions the model asked to call, if any
+	ToolCalls []interface{}
+	// Result is the full decoded response body
+	Result map[string]interface{}
+}
+
+// callUpstream sends payload to the NVIDIA NIM API, or whatever provider
+// UPSTREAM_REQUEST_TEMPLATE shapes it for, and extracts the answer from
+// UPSTREAM_ANSWER_PATH. With RETRY_ON_PARSE_ERROR, a 200 whose body isn't
+// valid JSON is retried once, since that is usually a transient glitch.
+func callUpstream(ctx context.Context, payload map[string]interface{}) (*completion, error) {
+	result, err := callUpstreamOnce(ctx, payload)
+	var apiErr *apiError
+	if cfg.RetryOnParseError && errors.As(err, &apiErr) && apiErr.Code == invalidUpstreamResponse {
+		log.Println("Retrying after an unparseable upstream response")
+		result, err = callUpstreamOnce(ctx, payload)
+	}
+
+	// RETRY_CONFIG retries upstream error statuses, waiting as long as the
+	// upstream's Retry-After asks or backing off exponentially
+	for attempt := 1; errors.As(err, &apiErr) && attempt <= cfg.StatusRetries[apiErr.upstreamStatus]; attempt++ {
+		delay := apiErr.retryAfter
+		if delay == 0 {
+			delay = retryBackoff << (attempt - 1)
+		}
+		log.Printf("Upstream returned %d, retry %d of %d in %s\n", apiErr.upstreamStatus, attempt, cfg.StatusRetries[apiErr.upstreamStatus], delay)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return result, err
+		}
+		result, err = callUpstreamOnce(ctx, payload)
+	}
+	return result, err
+}
+
+// retryBackoff is the wait before the first RETRY_CONFIG retry when the
+// upstream gives no Retry-After; it doubles with every retry.
+const retryBackoff = 500 * time.Millisecond
+
+// maxRetryAfter caps how long a Retry-After can make a retry wait.
+const maxRetryAfter = 30 * time.Second
+
+// parseRetryAfter reads a Retry-After header given in seconds, capped at
+// maxRetryAfter. HTTP dates and bad values count as absent.
+func parseRetryAfter(header string) time.Duration {
+	seconds, err := strconv.Atoi(strings.TrimSpace(header))
+	if err != nil || seconds <= 0 {
+		return 0
+	}
+	return min(time.Duration(seconds)*time.Second, maxRetryAfter)
+}
+
+// invalidUpstreamResponse is the error code for a 200 upstream response whose
+// body isn't valid JSON.
+const invalidUpstreamResponse = "invalid_upstream_response"
+
+// logSnippetBytes is how much of an unparseable upstream body is logged.
+const logSnippetBytes = 200
+
+func callUpstreamOnce(ctx context.Context, payload map[string]interface{}) (*completion, error) {
+	if cfg.DryRun {
+		return dryRunCompletion(payload), nil
+	}
+	if cfg.EnableEchoModel && payload["model"] == echoModel {
+		return echoCompletion(payload), nil
+	}
+	release, err := acquireLane(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	upstreamInFlight.Add(1)
+	defer upstreamInFlight.Add(-1)
+	slowForRateLimit(ctx)
+
+	// With several UPSTREAM_ENDPOINTS, an endpoint that fails hands the call
+	// on to the next best
+	var result *completion
+	for _, e := range rankedEndpoints() {
+		start := time.Now()
+		result, err = sendUpstream(ctx, payload, e.apiURL)
+		if shouldFailOver(ctx, err) {
+			e.record(0, false)
+			if len(endpoints) > 1 {
+				log.Printf("Upstream endpoint %s failed, trying the next: %v\n", e.apiURL, err)
+			}
+			continue
+		}
+		if ctx.Err() == nil && answeredByEndpoint(err) {
+			e.record(time.Since(start), true)
+		}
+		break
+	}
+	upstreamErrors.record(err != nil)
+	if err == nil {
+		addCost(result.Model, result.Usage)
+	}
+	return result, err
+}
+
+// sendUpstream makes one call to the upstream API at apiURL and decodes its
+// answer.
+func sendUpstream(ctx context.Context, payload map[string]interface{}, apiURL string) (*completion, error) {
+	jsonValue, err := renderRequestBody(payload)
+	if err != nil {
+		log.Printf("Error rendering upstream request body: %v\n", err)
+		return nil, &apiError{Status: http.StatusInternalServerError, Message: fmt.Sprintf("Error rendering upstream request body: %v", err)}
+	}
+	// Decide once whether this call's request and response bodies are logged
+	logBodies := rand.Float64() < cfg.UpstreamLogSampleRate
+	if logBodies {
+		log.Printf("Sending request to NVIDIA NIM API: %s\n", payloadForLog(ctx, payload))
+	} else {
+		messages, _ := payload["messages"].([]map[string]string)
+		log.Printf("Sending request to NVIDIA NIM API: model=%v messages=%d\n", payload["model"], len(messages))
+	}
+
+	// Create a new HTTP request
+	req, err := http.NewRequest("POST", apiURL, bytes.NewBuffer(jsonValue))
+	if err != nil {
+		log.Printf("Error creating request: %v\n", err)
+		return nil, &apiError{Status: http.StatusInternalServerError, Message: fmt.Sprintf("Error creating request: %v", err)}
+	}
+
+	model, _ := payload["model"].(string)
+	ctx, span := startUpstreamSpan(ctx, req, model)
+	defer span.End()
+
+	// The timeout covers the whole call, including reading the body
+	timeout := upstreamTimeout(model)
+	timeoutCtx := ctx
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		timeoutCtx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	req = req.WithContext(timeoutCtx)
+
+	// Set headers
+	req.Header.Set("Content-Type", "application/json")
+	keyIndex, apiKey := cfg.APIKeys.pick()
+	req.Header.Set("Authorization", "Bearer "+apiKey)
+	for key, value := range cfg.ExtraHeaders {
+		req.Header.Set(key, value)
+	}
+
+	// Send the request
+	sent := time.Now()
+	resp, err := upstreamClient.Do(req)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "upstream request failed")
+		if isResponseHeaderTimeout(err) {
+			log.Printf("Upstream sent no response headers within %s: %v\n", cfg.ResponseHeaderTimeout, err)
+			return nil, &apiError{Status: http.StatusGatewayTimeout, Message: "upstream slow to respond", transportFailed: true}
+		}
+		if hitTimeout(ctx, timeoutCtx) {
+			return nil, errUpstreamTimeout(model, timeout)
+		}
+		if errors.Is(err, errCrossHostRedirect) {
+			log.Printf("Upstream redirected to another host, set UPSTREAM_REDIRECT_POLICY=follow to allow it: %v\n", err)
+			return nil, &apiError{Status: http.StatusBadGateway, Message: "upstream redirected to another host"}
+		}
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			log.Printf("Client deadline passed during upstream call to %s\n", model)
+			return nil, errDeadlinePassed
+		}
+		log.Printf("Error sending request: %v\n", err)
+		return nil, &apiError{Status: http.StatusInternalServerError, Message: fmt.Sprintf("Error sending request: %v", err), transportFailed: true}
+	}
+	defer resp.Body.Close()
+
+	// The transport only decompresses transparently when it asked for gzip
+	// itself; with Accept-Encoding set through UPSTREAM_EXTRA_HEADERS the body
+	// arrives still compressed
+	var bodyReader io.Reader = resp.Body
+	if strings.EqualFold(resp.Header.Get("Content-Encoding"), "gzip") {
+		gz, err := gzip.NewReader(resp.Body)
+		if err != nil {
+			log.Printf("Error decompressing response body: %v\n", err)
+			return nil, &apiError{Status: http.StatusInternalServerError, Message: fmt.Sprintf("Error decompressing response body: %v", err)}
+		}
+		defer gz.Close()
+		bodyReader = gz
+	}
+
+	// Read the response body
+	body, err := ioutil.ReadAll(bodyReader)
+	if err != nil {
+		if hitTimeout(ctx, timeoutCtx) {
+			return nil, errUpstreamTimeout(model, timeout)
+		}
+		log.Printf("Error reading response body: %v\n", err)
+		return nil, &apiError{Status: http.StatusInternalServerError, Message: fmt.Sprintf("Error reading response body: %v", err), transportFailed: true}
+	}
+	addTiming(ctx, "upstream", time.Since(sent))
+
+	log.Printf("Response status: %s (API key %d)\n", resp.Status, keyIndex)
+	rateLimit := readRateLimit(resp.Header)
+	span.SetAttributes(semconv.HTTPResponseStatusCode(resp.StatusCode))
+	if resp.StatusCode != http.StatusOK {
+		span.SetStatus(codes.Error, resp.Status)
+	}
+	if logBodies {
+		log.Printf("Response body: %s\n", bodyForLog(ctx, body))
+	}
+
+	// A 401 means our own API key is bad, which the client can't fix; a 403
+	// means the key has no access to the requested model. A 429 benches the
+	// key so the next calls use the others.
+	switch resp.StatusCode {
+	case http.StatusUnauthorized:
+		log.Printf("ERROR: upstream rejected API key %d, check NVIDIA_API_KEY\n", keyIndex)
+		return nil, &apiError{Status: http.StatusBadGateway, Message: "upstream authentication failed"}
+	case http.StatusForbidden:
+		return nil, &apiError{Status: http.StatusForbidden, Message: "model not permitted"}
+	case http.StatusTooManyRequests:
+		if cfg.APIKeys.size() > 1 {
+			log.Printf("API key %d was rate limited, benching it for %s\n", keyIndex, cfg.APIKeys.cooldown)
+			cfg.APIKeys.bench(keyIndex)
+		}
+	}
+
+	// If the status is not 200 OK, return an error
+	if resp.StatusCode != http.StatusOK {
+		return nil, &apiError{
+			Status:         resp.StatusCode,
+			Message:        fmt.Sprintf("API returned non-200 status: %s\nBody: %s", resp.Status, string(body)),
+			upstreamStatus: resp.StatusCode,
+			retryAfter:     parseRetryAfter(resp.Header.Get("Retry-After")),
+		}
+	}
+
+	// If we got here, we have a 200 OK response
+	// Parse the response JSON
+	parseStart := time.Now()
+	var result map[string]interface{}
+	if err := json.Unmarshal(body, &result); err != nil {
+		log.Printf("Error parsing JSON response: %v, body starts: %s\n", err, bodyForLog(ctx, body[:min(len(body), logSnippetBytes)]))
+		return nil, &apiError{Status: http.StatusInternalServerError, Message: fmt.Sprintf("Error parsing JSON response: %v", err), Code: invalidUpstreamResponse}
+	}
+
+	// A tool call comes with null content instead of an answer
+	toolCalls := extractToolCalls(result)
+	answer, ok := extractAnswer(result)
+	if !ok && toolCalls == nil {
+		return nil, &apiError{Status: http.StatusInternalServerError, Message: "Unexpected response structure from API"}
+	}
+
+	addTiming(ctx, "parse", time.Since(parseStart))
+
+	done := &completion{Answer: answer, ToolCalls: toolCalls, RateLimit: rateLimit, Result: result}
+	if cfg.SplitReasoning {
+		done.Reasoning, done.Answer = splitReasoning(answer)
+	}
+	done.Model, _ = result["model"].(string)
+	if done.Model == "" {
+		done.Model, _ = payload["model"].(string)
+	}
+	done.Usage, _ = result["usage"].(map[string]interface{})
+	if choices, ok := result["choices"].([]interface{}); ok && len(choices) > 0 {
+		if firstChoice, ok := choices[0].(map[string]interface{}); ok {
+			done.FinishReason, _ = firstChoice["finish_reason"].(string)
+		}
+	}
+	return done, nil
+}
+
+// callUpstreamWithFallback calls the upstream with payload and, when
+// ENABLE_MODEL_FALLBACK is set and the model is not found, retries once with
+// FALLBACK_MODEL. payload keeps the fallback model so later retries use it
+// too; fellBack reports whether the substitution happened.
+func callUpstreamWithFallback(ctx context.Context, payload map[string]interface{}) (result *completion, fellBack bool, err error) {
+	result, err = callUpstream(ctx, payload)
+	var apiErr *apiError
+	if !cfg.EnableModelFallback || !errors.As(err, &apiErr) || apiErr.Status != http.StatusNotFound {
+		return result, false, err
+	}
+	if payload["model"] == cfg.FallbackModel {
+		return result, false, err
+	}
+
+	log.Printf("Model %v not found upstream, falling back to %s\n", payload["model"], cfg.FallbackModel)
+	payload["model"] = cfg.FallbackModel
+	result, err = callUpstream(ctx, payload)
+	return result, err == nil, err
+}
+
+// extractAnswer returns the string at UPSTREAM_ANSWER_PATH in a decoded
+// response, by default choices[0].message.content.
+func extractAnswer(result map[string]interface{}) (string, bool) {
+	value, ok := lookupPath(result, cfg.AnswerPath)
+	if !ok {
+		return "", false
+	}
+	answer, ok := value.(string)
+	return answer, ok
+}
+
+// extractToolCalls returns choices[0].message.tool_calls from a decoded
+// response, or nil when the model didn't call any tools.
+func extractToolCalls(result map[string]interface{}) []interface{} {
+	value, _ := lookupPath(result, "choices.0.message.tool_calls")
+	toolCalls, ok := value.([]interface{})
+	if !ok || len(toolCalls) == 0 {
+		return nil
+	}
+	return toolCalls
+}
+
+// dryRunAnswer is returned for every request in DRY_RUN mode.
+const dryRunAnswer = "This is a dry-run answer; the upstream API was not called."
+
+// dryRunCompletion stands in for an upstream call in DRY_RUN mode, waiting
+// DRY_RUN_LATENCY_MS to simulate the upstream round trip.
+func dryRunCompletion(payload map[string]interface{}) *completion {
+	time.Sleep(cfg.DryRunLatency)
+
+	model, _ := payload["model"].(string)
+	return &completion{
+		Answer:       dryRunAnswer,
+		Model:        model,
+		FinishReason: "stop",
+		// Numbers are float64, as if decoded from a real response
+		Usage: map[string]interface{}{
+			"prompt_tokens":     0.0,
+			"completion_tokens": 0.0,
+			"total_tokens":      0.0,
+		},
+		Result: map[string]interface{}{},
+	}
+}
+
+// echoModel is the model id that answers with the question itself when
+// ENABLE_ECHO_MODEL is set, for testing clients without calling the API.
+const echoModel = "echo"
+
+// echoCompletion answers with the last message of payload, transformed by
+// ECHO_MODEL_TRANSFORM so the answer is visibly not the input.
+func echoCompletion(payload map[string]interface{}) *completion {
+	messages, _ := payload["messages"].([]map[string]string)
+	var answer string
+	if len(messages) > 0 {
+		answer = messages[len(messages)-1]["content"]
+	}
+
+	switch cfg.EchoModelTransform {
+	case "upper":
+		answer = strings.ToUpper(answer)
+	case "reverse":
+		runes := []rune(answer)
+		for i, j := 0, len(runes)-1; i < j; i, j = i+1, j-1 {
+			runes[i], runes[j] = runes[j], runes[i]
+		}
+		answer = string(runes)
+	}
+
+	return &completion{
+		Answer:       answer,
+		Model:        echoModel,
+		FinishReason: "stop",
+		Usage: map[string]interface{}{
+			"prompt_tokens":     0.0,
+			"completion_tokens": 0.0,
+			"total_tokens":      0.0,
+		},
+		Result: map[string]interface{}{},
+	}
+}
+
+// extractSources returns the citations of a retrieval-augmented response, or
+// nil when there are none. Providers put them in different places: at the
+// top level, on the message, or under the message's "context" (Azure), so
+// each is checked in turn and the first non-empty array wins.
+func extractSources(result map[string]interface{}) []interface{} {
+	candidates := []interface{}{result["citations"]}
+	if choices, ok := result["choices"].([]interface{}); ok && len(choices) > 0 {
+		if firstChoice, ok := choices[0].(map[string]interface{}); ok {
+			if message, ok := firstChoice["message"].(map[string]interface{}); ok {
+				candidates = append(candidates, message["citations"])
+				if context, ok := message["context"].(map[string]interface{}); ok {
+					candidates = append(candidates, context["citations"])
+				}
+			}
+		}
+	}
+
+	for _, candidate := range candidates {
+		if sources, ok := candidate.([]interface{}); ok && len(sources) > 0 {
+			return sources
+		}
+	}
+	return nil
+}
+
+// errEmptyAnswer is returned when the upstream succeeds but the answer is
+// blank, unless EMPTY_ANSWER_MODE=allow.
+var errEmptyAnswer = &apiError{
+	Status:  http.StatusBadGateway,
+	Message: "The model returned an empty answer",
+	Code:    "empty_answer",
+}
+
+// isEmptyAnswer reports whether answer has no content besides whitespace.
+func isEmptyAnswer(answer string) bool {
+	return strings.TrimSpace(answer) == ""
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"net/http"
+	"sync/atomic"
+	"testing"
+)
+
+func TestUpstreamAuthErrors(t *testing.T) {
+	tests := []struct {
+		upstreamStatus int
+		wantStatus     int
+		wantError      string
+	}{
+		{http.StatusUnauthorized, http.StatusBadGateway, "upstream authentication failed"},
+		{http.StatusForbidden, http.StatusForbidden, "model not permitted"},
+	}
+	for _, tt := range tests {
+		t.Run(http.StatusText(tt.upstreamStatus), func(t *testing.T) {
+			app := newTestApp(t, func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(tt.upstreamStatus)
+			}, nil)
+			status, body := postChat(t, app, "/chat/", `{"question": "hello"}`)
+			if status != tt.wantStatus || body["error"] != tt.wantError {
+				t.Errorf("got %d %v, want %d %q", status, body["error"], tt.wantStatus, tt.wantError)
+			}
+		})
+	}
+}
+
+func TestRetryOnParseError(t *testing.T) {
+	tests := []struct {
+		name       string
+		retry      string
+		wantStatus int
+		wantCalls  int64
+	}{
+		{"retried once", "true", http.StatusOK, 2},
+		{"not retried when off", "false", http.StatusInternalServerError, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var calls atomic.Int64
+			app := newTestApp(t, func(w http.ResponseWriter, r *http.Request) {
+				if calls.Add(1) == 1 {
+					w.Write([]byte(`{"choices": [`))
+					return
+				}
+				writeCompletion(w, "hello")
+			}, map[string]string{"RETRY_ON_PARSE_ERROR": tt.retry})
+
+			status, body := postChat(t, app, "/chat/", `{"question": "hello"}`)
+			if status != tt.wantStatus {
+				t.Errorf("status = %d %v, want %d", status, body, tt.wantStatus)
+			}
+			if got := calls.Load(); got != tt.wantCalls {
+				t.Errorf("upstream called %d times, want %d", got, tt.wantCalls)
+			}
+		})
+	}
+}
+
+func TestGzipUpstreamResponse(t *testing.T) {
+	var compressed bytes.Buffer
+	gz := gzip.NewWriter(&compressed)
+	gz.Write([]byte(`{"model": "m", "choices": [{"finish_reason": "stop", "message": {"role": "assistant", "content": "unzipped answer"}}]}`))
+	gz.Close()
+
+	tests := []struct {
+		name       string
+		body       []byte
+		wantStatus int
+		wantAnswer interface{}
+	}{
+		{"gzip body decoded", compressed.Bytes(), http.StatusOK, "unzipped answer"},
+		{"bad gzip body rejected", []byte("not gzip at all"), http.StatusInternalServerError, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApp(t, func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Encoding", "gzip")
+				w.Write(tt.body)
+			}, map[string]string{"UPSTREAM_EXTRA_HEADERS": "Accept-Encoding:gzip"})
+
+			status, body := postChat(t, app, "/chat/", `{"question": "hello"}`)
+			if status != tt.wantStatus || body["answer"] != tt.wantAnswer {
+				t.Errorf("got %d %v, want %d answer %v", status, body, tt.wantStatus, tt.wantAnswer)
+			}
+		})
+	}
+}
+
+func TestToolCallsWithNullContent(t *testing.T) {
+	app := newTestApp(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"model": "m", "choices": [{"finish_reason": "tool_calls", "message": {"role": "assistant", "content": null, "tool_calls": [{"id": "call_1", "type": "function", "function": {"name": "get_weather", "arguments": "{\"city\": \"Paris\"}"}}]}}]}`))
+	}, nil)
+
+	status, body := postChat(t, app, "/chat/", `{"question": "weather in Paris?", "tools": [{"type": "function", "function": {"name": "get_weather", "parameters": {"type": "object"}}}]}`)
+	if status != http.StatusOK {
+		t.Fatalf("got %d %v, want 200", status, body)
+	}
+	calls, _ := body["tool_calls"].([]interface{})
+	if len(calls) != 1 {
+		t.Fatalf("tool_calls = %v, want the one call", body["tool_calls"])
+	}
+	function, _ := calls[0].(map[string]interface{})["function"].(map[string]interface{})
+	if function["name"] != "get_weather" || function["arguments"] != `{"city": "Paris"}` {
+		t.Errorf("tool call = %v, want get_weather with its arguments", calls[0])
+	}
+	if body["empty_answer"] != nil {
+		t.Errorf("tool call reported as empty_answer: %v", body)
+	}
+}
+
+func TestEmptyAnswer(t *testing.T) {
+	t.Run("error", func(t *testing.T) {
+		app := newTestApp(t, answerWith(""), nil)
+		status, body := postChat(t, app, "/chat/", `{"question": "hello"}`)
+		if status != http.StatusBadGateway || body["code"] != "empty_answer" || body["error"] != "The model returned an empty answer" {
+			t.Errorf("got %d %v, want 502 empty_answer", status, body)
+		}
+	})
+	t.Run("allow", func(t *testing.T) {
+		app := newTestApp(t, answerWith(""), map[string]string{"EMPTY_ANSWER_MODE": "allow"})
+		status, body := postChat(t, app, "/chat/", `{"question": "hello"}`)
+		if status != http.StatusOK || body["answer"] != "" || body["empty_answer"] != true {
+			t.Errorf("got %d %v, want 200 with empty_answer", status, body)
+		}
+	})
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"github.com/gofiber/fiber/v2"
+)
+
+// validateHandler checks a /chat/ body the way chatHandler would, including
+// profile, persona, canned answer and model choice, without calling the
+// upstream. A valid request gets the parameters it would be sent with and any
+// warnings about fields that were ignored; an invalid one gets the same error
+// /chat/ would return.
+func validateHandler(c *fiber.Ctx) error {
+	req, err := readChatRequest(c)
+	if err != nil {
+		return errorResponse(c, err)
+	}
+
+	_, payload, err := buildChatPayload(req)
+	if err != nil {
+		return errorResponse(c, err)
+	}
+	if _, _, _, err := finalizeChatPayload(c, payload, req); err != nil {
+		return errorResponse(c, err)
+	}
+
+	warnings := req.Warnings
+	if warnings == nil {
+		warnings = []string{}
+	}
+	return c.JSON(fiber.Map{
+		"valid":            true,
+		"effective_params": effectiveParams(payload, req),
+		"warnings":         warnings,
+	})
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestValidateMatchesChat(t *testing.T) {
+	canned := filepath.Join(t.TempDir(), "canned.json")
+	if err := os.WriteFile(canned, []byte(`{"what are your hours": "Nine to five."}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("canned only", func(t *testing.T) {
+		app := newTestApp(t, answerWith("hello"), map[string]string{
+			"CANNED_ANSWERS_PATH": canned,
+			"CANNED_ONLY":         "true",
+		})
+		for _, path := range []string{"/chat/", "/chat/validate"} {
+			status, body := postChat(t, app, path, `{"question": "Where are you?"}`)
+			if status != http.StatusNotFound || body["code"] != "not_canned" {
+				t.Errorf("%s: got %d %v, want 404 not_canned", path, status, body)
+			}
+		}
+		if status, body := postChat(t, app, "/chat/validate", `{"question": "What are your hours?"}`); status != http.StatusOK {
+			t.Errorf("canned question: got %d %v, want 200", status, body)
+		}
+	})
+
+	t.Run("escalation cheap start", func(t *testing.T) {
+		app := newTestApp(t, answerWith("a long enough answer from the cheap model"), map[string]string{
+			"ENABLE_ESCALATION":      "true",
+			"ESCALATION_CHEAP_MODEL": "cheap-model",
+			"ESCALATION_MODEL":       "big-model",
+		})
+		status, body := postChat(t, app, "/chat/validate", `{"question": "hello"}`)
+		params, _ := body["effective_params"].(map[string]interface{})
+		if status != http.StatusOK || params["model"] != "cheap-model" {
+			t.Errorf("got %d %v, want 200 with model cheap-model", status, body)
+		}
+	})
+}
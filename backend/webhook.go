@@ -0,0 +1,73 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+)
+
+// postProcessRequest is what POST_PROCESS_WEBHOOK_URL is sent for each
+// answer. The webhook answers {"answer": "..."} with the answer to return.
+type postProcessRequest struct {
+	RequestID string `json:"request_id"`
+	Question  string `json:"question"`
+	Answer    string `json:"answer"`
+	Model     string `json:"model"`
+}
+
+// postProcessAnswer passes answer through the post-processing webhook and
+// returns what it sends back. It fails open: when the webhook is unset,
+// errors, times out or answers badly, the original answer is returned.
+func postProcessAnswer(ctx context.Context, req postProcessRequest) string {
+	if cfg.PostProcessWebhookURL == "" {
+		return req.Answer
+	}
+
+	answer, err := callPostProcessWebhook(ctx, req)
+	if err != nil {
+		log.Printf("Error calling post-process webhook, keeping the original answer: %v\n", err)
+		return req.Answer
+	}
+	return answer
+}
+
+func callPostProcessWebhook(ctx context.Context, req postProcessRequest) (string, error) {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return "", err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, cfg.PostProcessWebhookTimeout)
+	defer cancel()
+	httpReq, err := http.NewRequestWithContext(ctx, "POST", cfg.PostProcessWebhookURL, bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+
+	resp, err := http.DefaultClient.Do(httpReq)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("status %s", resp.Status)
+	}
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+
+	var processed struct {
+		Answer *string `json:"answer"`
+	}
+	if err := json.Unmarshal(respBody, &processed); err != nil || processed.Answer == nil {
+		return "", fmt.Errorf("expected an object with a string field answer")
+	}
+	return *processed.Answer, nil
+}